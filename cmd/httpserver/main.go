@@ -1,76 +1,189 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"slices"
 	"syscall"
+	"time"
 
+	"github.com/sevaergdm/httpfromtcp/internal/activation"
 	"github.com/sevaergdm/httpfromtcp/internal/headers"
 	"github.com/sevaergdm/httpfromtcp/internal/request"
 	"github.com/sevaergdm/httpfromtcp/internal/response"
+	"github.com/sevaergdm/httpfromtcp/internal/router"
 	"github.com/sevaergdm/httpfromtcp/internal/server"
 )
 
 const port = 42069
 
+const shutdownTimeout = 30 * time.Second
+
+const (
+	accessLogMaxBytes = 10 << 20
+	accessLogBackups  = 5
+)
+
 func main() {
-	server, err := server.Serve(routingHandler, port)
+	rt := router.New()
+	rt.HandleFunc("/httpbin/{path...}", proxyHandler)
+	rt.Handle("/video", handlerVideo)
+	rt.Handle("/{path...}", handler)
+
+	accessLog, err := newAccessLog()
+	if err != nil {
+		log.Fatalf("Error opening access log: %v", err)
+	}
+
+	srv := &server.Server{
+		Handler:           rt.Serve,
+		ReadHeaderTimeout: server.DefaultReadHeaderTimeout,
+		IdleTimeout:       server.DefaultIdleTimeout,
+		AccessLog:         accessLog,
+	}
+
+	// Serve HTTPS when a certificate is configured. SIGHUP reloads it.
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" && keyFile != "" {
+		certs, err := server.LoadCertStore(server.KeyPair{CertFile: certFile, KeyFile: keyFile})
+		if err != nil {
+			log.Fatalf("Error loading certificate: %v", err)
+		}
+		srv.Certificates = certs
+	}
+
+	listeners, err := listen()
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	for _, l := range listeners {
+		if srv.Certificates != nil {
+			err = srv.StartTLSListener(l)
+		} else {
+			srv.StartListener(l)
+		}
+		if err != nil {
+			log.Fatalf("Error starting server: %v", err)
+		}
+		log.Printf("Server listening on %s (%s)", l.Addr(), l.Name)
+	}
+	err = activation.Ready()
+	if err != nil {
+		log.Printf("Unable to signal readiness: %v", err)
+	}
 
+	// An upgrade signal hands the listeners to a new copy of the binary, then
+	// drains.
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, upgradeSignals...)...)
+	for sig := range sigChan {
+		if slices.Contains(upgradeSignals, sig) {
+			if upgrade(listeners) {
+				break
+			}
+			continue
+		}
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if srv.Certificates == nil {
+			continue
+		}
+		err := srv.Certificates.Reload()
+		if err != nil {
+			log.Printf("Unable to reload certificates: %v", err)
+			continue
+		}
+		log.Println("Reloaded certificates")
+	}
+	log.Println("Server shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Server forced to stop: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
 
-func routingHandler(w *response.Writer, r *request.Request) {
-	if strings.HasPrefix(r.RequestLine.RequestTarget, "/httpbin/") {
-		proxyHandler(w, r)
-		return
-	}else if strings.HasPrefix(r.RequestLine.RequestTarget, "/video") {
-		handlerVideo(w, r)
-		return
-	} else {
-		handler(w, r)
-		return
+// listen returns the listeners passed in by systemd or a previous process,
+// or listens on port if there are none.
+func listen() ([]activation.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
 	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return []activation.Listener{{Listener: l, Name: "http"}}, nil
 }
 
-func proxyHandler(w *response.Writer, r *request.Request) {
-	target := strings.TrimPrefix(r.RequestLine.RequestTarget, "/httpbin/")
-	url := "https://httpbin.org/" + target
-	log.Printf("Proxying to: %s\n", url)
+// newAccessLog logs requests in the format named by ACCESS_LOG_FORMAT
+// ("common", "combined" or "json") to standard output, or to the file named
+// by ACCESS_LOG_FILE, rotated as it grows.
+func newAccessLog() (*server.AccessLog, error) {
+	accessLog := &server.AccessLog{Format: server.CombinedLogFormat}
+	switch os.Getenv("ACCESS_LOG_FORMAT") {
+	case "common":
+		accessLog.Format = server.CommonLogFormat
+	case "json":
+		accessLog.Format = server.JSONLogFormat
+	}
+
+	if path := os.Getenv("ACCESS_LOG_FILE"); path != "" {
+		file, err := server.OpenRotatingFile(path, accessLogMaxBytes, accessLogBackups)
+		if err != nil {
+			return nil, err
+		}
+		accessLog.Output = file
+	}
+	return accessLog, nil
+}
+
+func proxyHandler(w *response.Writer, r *request.Request) error {
+	target := &url.URL{
+		Scheme:   "https",
+		Host:     "httpbin.org",
+		Path:     "/" + r.PathValue("path"),
+		RawQuery: r.URL.RawQuery,
+	}
 	header := headers.NewHeaders()
 
-	resp, err := http.Get(url)
-	log.Printf("Got response status code: %d", resp.StatusCode)
+	upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
 	if err != nil {
-		log.Printf("Unable to make get request: %v", err)
-		w.WriteStatusLine(response.StatusCode(http.StatusBadGateway))
-		w.WriteHeaders(header)
-		return
+		return err
+	}
+	resp, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		return &server.HandlerError{
+			StatusCode: response.BadGateway,
+			Message:    fmt.Sprintf("Unable to make get request: %v", err),
+		}
 	}
 	defer resp.Body.Close()
 
 	w.WriteStatusLine(response.StatusCode(resp.StatusCode))
-	for k, v := range resp.Header {
+	for k, values := range resp.Header {
 		if k == "Content-Length" {
 			continue
 		}
-		vString := strings.Join(v, ", ")
-		header.Set(k, vString)
+		for _, v := range values {
+			header.Add(k, v)
+		}
 	}
 	header.Set("Transfer-Encoding", "chunked")
 	header.Set("Trailer", "X-Content-SHA256, X-Content-Length")
@@ -82,7 +195,6 @@ func proxyHandler(w *response.Writer, r *request.Request) {
 		n, err := resp.Body.Read(buf)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				log.Println("All bytes read")
 				break
 			}
 			log.Printf("Error while reading response body: %v", err)
@@ -91,7 +203,6 @@ func proxyHandler(w *response.Writer, r *request.Request) {
 		if n == 0 {
 			continue
 		}
-		log.Printf("Successfully read %d bytes", n)
 
 		_, err = w.WriteChunkedBody(buf[:n])
 		if err != nil {
@@ -99,8 +210,6 @@ func proxyHandler(w *response.Writer, r *request.Request) {
 			break
 		}
 		body = append(body, buf[:n]...)
-		log.Printf("Successfully wrote %d bytes", n)
-		log.Printf("Body is %d bytes", len(body))
 	}
 
 	_, err = w.WriteChunkedBodyDone()
@@ -116,10 +225,11 @@ func proxyHandler(w *response.Writer, r *request.Request) {
 	if err != nil {
 		log.Println("Unable to write trailers")
 	}
+	return nil
 }
 
 func handler(w *response.Writer, r *request.Request) {
-	if r.RequestLine.RequestTarget == "/yourproblem" {
+	if r.URL.Path == "/yourproblem" {
 		w.WriteStatusLine(response.BadRequest)
 		header := headers.NewHeaders()
 		body := []byte("<html><head><title>400 Bad Request</title></head><body><h1>Bad Request</h1><p>Your request honestly kinda sucked.</p></body></html>")
@@ -131,7 +241,7 @@ func handler(w *response.Writer, r *request.Request) {
 		return
 	}
 
-	if r.RequestLine.RequestTarget == "/myproblem" {
+	if r.URL.Path == "/myproblem" {
 		w.WriteStatusLine(response.InternalServerError)
 		header := headers.NewHeaders()
 		body := []byte(`<html>
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+
+	"github.com/sevaergdm/httpfromtcp/internal/activation"
+)
+
+// upgradeSignals is empty: listeners can only be handed to a new process on
+// Unix.
+var upgradeSignals []os.Signal
+
+func upgrade(listeners []activation.Listener) bool {
+	return false
+}
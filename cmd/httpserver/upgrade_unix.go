@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sevaergdm/httpfromtcp/internal/activation"
+)
+
+const upgradeTimeout = 30 * time.Second
+
+// upgradeSignals start an upgrade: SIGUSR2 hands the listeners to a new copy
+// of the binary.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// upgrade starts a new process on the same listeners, reporting whether it
+// took over.
+func upgrade(listeners []activation.Listener) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+	defer cancel()
+	proc, err := activation.Upgrade(ctx, listeners)
+	if err != nil {
+		log.Printf("Upgrade failed: %v", err)
+		return false
+	}
+	log.Printf("Handed listeners to process %d", proc.Pid)
+	return true
+}
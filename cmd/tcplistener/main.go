@@ -34,11 +34,15 @@ func main() {
 			fmt.Printf("- Target: %s\n", req.RequestLine.RequestTarget)
 			fmt.Printf("- Version: %s\n", req.RequestLine.HttpVersion)
 			fmt.Println("Headers:")
-			for k, v := range req.Headers  {
+			for k, v := range req.Headers.All()  {
 				fmt.Printf("- %s: %s\n", k, v)
 			}
+			body, err := req.BodyBytes()
+			if err != nil {
+				log.Fatal(err)
+			}
 			fmt.Println("Body:")
-			fmt.Println(string(req.Body))
+			fmt.Println(string(body))
 
 			fmt.Println("Connection has been closed")
 		}(conn)
@@ -0,0 +1,27 @@
+// Package activation receives listening sockets passed in by systemd socket
+// activation or by a running server handing over to its replacement. Both
+// pass file descriptors between processes, so they are only supported on
+// Unix.
+package activation
+
+import "net"
+
+// listenFdsStart is the first file descriptor passed to an activated
+// process, following stdin, stdout and stderr.
+const listenFdsStart = 3
+
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	// envReadyFD names the pipe a process started by Upgrade writes to once
+	// it is serving.
+	envReadyFD = "HTTPFROMTCP_READY_FD"
+)
+
+// Listener is an inherited listening socket and the name it was passed
+// under.
+type Listener struct {
+	net.Listener
+	Name string
+}
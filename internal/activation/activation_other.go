@@ -0,0 +1,27 @@
+//go:build !unix
+
+package activation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Listeners returns no listeners: there is no socket activation on this
+// platform.
+func Listeners() ([]Listener, error) {
+	return nil, nil
+}
+
+// Ready does nothing, as no process can have been started by Upgrade.
+func Ready() error {
+	return nil
+}
+
+// Upgrade always fails: listeners can't be passed to another process on
+// this platform.
+func Upgrade(ctx context.Context, listeners []Listener) (*os.Process, error) {
+	return nil, fmt.Errorf("unable to upgrade: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,176 @@
+//go:build unix
+
+package activation
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Listeners returns the listening sockets passed to this process with the
+// LISTEN_FDS protocol, or none if there are none. The LISTEN_* variables are
+// removed from the environment so child processes don't inherit them.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv(envListenPID)
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenFDNames)
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s: %q", envListenFDs, os.Getenv(envListenFDs))
+	}
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+
+	listeners := make([]Listener, 0, n)
+	for i := range n {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("unable to use file descriptor %d (%s): %w", fd, name, err)
+		}
+		listeners = append(listeners, Listener{Listener: l, Name: name})
+	}
+	return listeners, nil
+}
+
+// Ready tells the process that started this one with Upgrade that it is
+// serving, so the old process can drain and exit. It does nothing if this
+// process wasn't started by Upgrade.
+func Ready() error {
+	value, ok := os.LookupEnv(envReadyFD)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %q", envReadyFD, value)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// Upgrade starts a new copy of the running executable with the same
+// arguments, passing it listeners with the LISTEN_FDS protocol, and waits
+// for it to call Ready. The caller keeps its own copies of the listeners
+// and should stop accepting on them and drain once Upgrade returns. If the
+// new process exits or ctx expires before it is ready, it is killed and
+// the caller carries on serving.
+func Upgrade(ctx context.Context, listeners []Listener) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		fl, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %s can't be passed to another process", l.Name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, l.Name)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	// LISTEN_PID must hold the new process's pid, which isn't known until it
+	// has started, so a shell sets it before replacing itself with exe.
+	cmd := exec.Command("/bin/sh", append([]string{"-c", `LISTEN_PID=$$ exec "$0" "$@"`, exe}, os.Args[1:]...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environWithout(envListenPID, envListenFDs, envListenFDNames, envReadyFD),
+		envListenFDs+"="+strconv.Itoa(len(listeners)),
+		envListenFDNames+"="+strings.Join(names, ":"),
+		envReadyFD+"="+strconv.Itoa(listenFdsStart+len(listeners)),
+	)
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	// Only the new process may hold the write end, so that reading sees EOF
+	// if it exits before it is ready.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new process did not become ready: %w", err)
+	}
+
+	// The new process serves these sockets now, so closing them here must not
+	// remove their files.
+	for _, l := range listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
+
+func environWithout(keys ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(keys, key) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
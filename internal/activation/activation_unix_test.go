@@ -0,0 +1,122 @@
+//go:build unix
+
+package activation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// envTestChild makes the test binary act as the process started by Upgrade.
+const envTestChild = "ACTIVATION_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(envTestChild) {
+	case "":
+		os.Exit(m.Run())
+	case "serve":
+		os.Exit(runChild())
+	case "fail":
+		os.Exit(1)
+	}
+}
+
+// runChild answers one connection on each inherited listener with its name
+// and the child's pid.
+func runChild() int {
+	listeners, err := Listeners()
+	if err != nil || len(listeners) == 0 {
+		fmt.Fprintf(os.Stderr, "no listeners: %v\n", err)
+		return 1
+	}
+	if os.Getenv(envListenFDs) != "" {
+		fmt.Fprintln(os.Stderr, "environment not cleared")
+		return 1
+	}
+	err = Ready()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ready: %v\n", err)
+		return 1
+	}
+	for _, l := range listeners {
+		c, err := l.Accept()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintf(c, "%s %d", l.Name, os.Getpid())
+		c.Close()
+	}
+	return 0
+}
+
+func TestUpgrade(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+	sock := t.TempDir() + "/admin.sock"
+	unix, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	defer unix.Close()
+
+	// Test: New process serves the handed over listeners
+	t.Setenv(envTestChild, "serve")
+	proc, err := Upgrade(ctx, []Listener{{Listener: tcp, Name: "http"}, {Listener: unix, Name: "admin"}})
+	require.NoError(t, err)
+	tcp.Close()
+	unix.Close()
+
+	c, err := net.Dial("tcp", tcp.Addr().String())
+	require.NoError(t, err)
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, "http "+strconv.Itoa(proc.Pid), string(resp))
+
+	// Test: Closing the old listener leaves the socket file for the new process
+	c, err = net.Dial("unix", sock)
+	require.NoError(t, err)
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, "admin "+strconv.Itoa(proc.Pid), string(resp))
+
+	state, err := proc.Wait()
+	require.NoError(t, err)
+	assert.True(t, state.Success())
+
+	// Test: A process that exits before it is ready fails the upgrade
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	t.Setenv(envTestChild, "fail")
+	_, err = Upgrade(ctx, []Listener{{Listener: l, Name: "http"}})
+	assert.Error(t, err)
+}
+
+func TestListeners(t *testing.T) {
+	// Test: No listeners without LISTEN_FDS
+	listeners, err := Listeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+
+	// Test: Listeners meant for another process are ignored
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()+1))
+	t.Setenv(envListenFDs, "1")
+	listeners, err = Listeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	assert.Empty(t, os.Getenv(envListenFDs))
+
+	// Test: Ready does nothing outside an upgrade
+	assert.NoError(t, Ready())
+}
@@ -2,62 +2,235 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"regexp"
+	"iter"
 	"strings"
 )
 
 const crlf = "\r\n"
 
-type Headers map[string]string
+var (
+	ErrInvalidFieldName  = errors.New("invalid field name")
+	ErrInvalidFieldValue = errors.New("invalid field value")
+	// ErrObsFold reports a field line continued on the next line by
+	// starting it with whitespace, which RFC 9112 section 5.2 deprecates.
+	ErrObsFold = errors.New("obsolete line folding")
+)
+
+// Field is a single header field line.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers is an ordered list of header fields. Names are matched without
+// regard to case but keep the case they were added with, and a name may
+// appear on several field lines, as Set-Cookie does. A nil *Headers is
+// empty.
+type Headers struct {
+	fields []Field
+}
+
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+// Parse parses one field line from data, or the empty line ending the
+// section, reporting how many bytes it consumed. Field lines continued with
+// obsolete line folding are rejected with ErrObsFold.
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false)
+}
 
-func NewHeaders() (Headers) {
-	return make(Headers)
+// ParseUnfolding is like Parse but accepts obsolete line folding, joining
+// each continuation line to the field before it with a space.
+func (h *Headers) ParseUnfolding(data []byte) (n int, done bool, err error) {
+	return h.parse(data, true)
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) parse(data []byte, unfold bool) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
-		return  0, false , nil
+		return 0, false, nil
 	}
-	if idx  == 0 {
+	if idx == 0 {
 		return 2, true, nil
 	}
 
-	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
-	key := string(parts[0])
-	if key != strings.TrimRight(key, " ") {
-		return 0, false, fmt.Errorf("Invalid header line")
+	line := data[:idx]
+	if isWhitespace(line[0]) && h.Len() > 0 {
+		if !unfold {
+			return 0, false, ErrObsFold
+		}
+		value := string(bytes.Trim(line, " \t"))
+		if !ValidFieldValue(value) {
+			return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldValue, value)
+		}
+		last := &h.fields[len(h.fields)-1]
+		switch {
+		case last.Value == "":
+			last.Value = value
+		case value != "":
+			last.Value += " " + value
+		}
+		return idx + 2, false, nil
 	}
 
-	value := bytes.TrimSpace(parts[1])
-	key = strings.TrimSpace(key)
-
-	pattern := "[^a-zA-Z\\d!#$%&'*+-.^_`|~:]"
+	key, value, ok := bytes.Cut(line, []byte(":"))
+	if !ok {
+		return 0, false, fmt.Errorf("%w: missing colon in field line: %q", ErrInvalidFieldName, line)
+	}
+	if len(key) > 0 && isWhitespace(key[len(key)-1]) {
+		return 0, false, fmt.Errorf("%w: whitespace before colon: %q", ErrInvalidFieldName, key)
+	}
 
-	match, _ := regexp.MatchString(pattern, key)
-	if match {
-		return 0, false, fmt.Errorf("Invalid character in field-name: %s", key)
+	name := string(bytes.TrimLeft(key, " \t"))
+	if !ValidFieldName(name) {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldName, name)
+	}
+	fieldValue := string(bytes.Trim(value, " \t"))
+	if !ValidFieldValue(fieldValue) {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldValue, fieldValue)
 	}
 
-	h.Set(key, string(value))
+	h.Add(name, fieldValue)
 	return idx + 2, false, nil
 }
 
-func (h Headers) Set(key, value string) {
-	key = strings.ToLower(key)
-	v, ok := h[key]
-	if ok {
-		value = strings.Join([]string{
-			v,
-			value,
-		}, ", ")
+// ValidFieldName reports whether name is a token, as RFC 9110 section 5.1
+// requires of field names.
+func ValidFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidFieldValue reports whether value holds only the characters RFC 9110
+// section 5.5 allows in a field value: visible characters, spaces and tabs.
+// CR, LF, NUL and other control characters are rejected, so a value can
+// never end its field line early.
+func ValidFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+	}
+}
+
+// Get returns the value of the first field named key.
+func (h *Headers) Get(key string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns the values of every field named key, in order.
+func (h *Headers) Values(key string) []string {
+	if h == nil {
+		return nil
 	}
-	h[key] = value
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Has reports whether a field named key is present.
+func (h *Headers) Has(key string) bool {
+	_, ok := h.Get(key)
+	return ok
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	key = strings.ToLower(key)
-	v, ok := h[key]
-	return v, ok
+// Add appends a field, keeping any others with the same name.
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{Name: key, Value: value})
+}
+
+// Set replaces every field named key with a single one holding value. The
+// field takes the place of the first one it replaces, or is appended.
+func (h *Headers) Set(key, value string) {
+	replaced := false
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.Name, key) {
+			fields = append(fields, f)
+			continue
+		}
+		if !replaced {
+			fields = append(fields, Field{Name: key, Value: value})
+			replaced = true
+		}
+	}
+	h.fields = fields
+	if !replaced {
+		h.Add(key, value)
+	}
+}
+
+// Del removes every field named key.
+func (h *Headers) Del(key string) {
+	if h == nil {
+		return
+	}
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.Name, key) {
+			fields = append(fields, f)
+		}
+	}
+	clear(h.fields[len(fields):])
+	h.fields = fields
+}
+
+// Len returns the number of fields.
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
+}
+
+// All iterates over the fields' names and values in order.
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if h == nil {
+			return
+		}
+		for _, f := range h.fields {
+			if !yield(f.Name, f.Value) {
+				return
+			}
+		}
+	}
 }
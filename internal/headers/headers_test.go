@@ -13,7 +13,7 @@ func TestParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -31,18 +31,19 @@ func TestParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 40, n)
 	assert.False(t, done)
 
 	// Test: Valid two headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, headers.Values("user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -64,12 +65,135 @@ func TestParse(t *testing.T) {
 	assert.False(t, done)
 
 	// Test: Valid two headers with same key
-	headers = map[string]string{"set-person": "Steve"}
+	headers = NewHeaders()
+	headers.Add("Set-Person", "Steve")
 	data = []byte("Set-Person: Jim\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "Steve, Jim", headers["set-person"])
+	assert.Equal(t, []string{"Steve", "Jim"}, headers.Values("set-person"))
 	assert.Equal(t, 17, n)
 	assert.False(t, done)
 }
+
+func TestHeaders(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Content-Type", "text/html")
+	h.Add("Set-Cookie", "a=1")
+	h.Add("X-Request-ID", "42")
+	h.Add("set-cookie", "b=2; Path=/")
+
+	// Test: Lookups ignore case
+	v, ok := h.Get("content-type")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", v)
+	assert.True(t, h.Has("X-REQUEST-ID"))
+	assert.False(t, h.Has("Accept"))
+	_, ok = h.Get("Accept")
+	assert.False(t, ok)
+
+	// Test: Repeated fields keep every value
+	v, _ = h.Get("Set-Cookie")
+	assert.Equal(t, "a=1", v)
+	assert.Equal(t, []string{"a=1", "b=2; Path=/"}, h.Values("Set-Cookie"))
+	assert.Nil(t, h.Values("Accept"))
+
+	// Test: Iteration keeps order and original case
+	var lines []string
+	for name, value := range h.All() {
+		lines = append(lines, name+": "+value)
+	}
+	assert.Equal(t, []string{"Content-Type: text/html", "Set-Cookie: a=1", "X-Request-ID: 42", "set-cookie: b=2; Path=/"}, lines)
+	assert.Equal(t, 4, h.Len())
+
+	// Test: Set replaces every value in place of the first
+	h.Set("SET-COOKIE", "c=3")
+	assert.Equal(t, []string{"c=3"}, h.Values("set-cookie"))
+	lines = nil
+	for name := range h.All() {
+		lines = append(lines, name)
+	}
+	assert.Equal(t, []string{"Content-Type", "SET-COOKIE", "X-Request-ID"}, lines)
+
+	// Test: Set appends a new field
+	h.Set("Cache-Control", "no-store")
+	assert.Equal(t, 4, h.Len())
+	v, _ = h.Get("cache-control")
+	assert.Equal(t, "no-store", v)
+
+	// Test: Del removes every value
+	h.Add("X-Request-ID", "43")
+	h.Del("x-request-id")
+	assert.False(t, h.Has("X-Request-ID"))
+	assert.Equal(t, 3, h.Len())
+
+	// Test: Nil headers are empty
+	var empty *Headers
+	assert.False(t, empty.Has("Host"))
+	assert.Equal(t, 0, empty.Len())
+	for range empty.All() {
+		t.Fatal("nil headers have no fields")
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	// Test: Line without a colon
+	h := NewHeaders()
+	_, _, err := h.Parse([]byte("Host localhost:42069\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidFieldName)
+
+	// Test: Tab before the colon
+	_, _, err = h.Parse([]byte("Host\t: localhost:42069\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidFieldName)
+
+	// Test: Empty and non-token names
+	_, _, err = h.Parse([]byte(": localhost:42069\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidFieldName)
+	_, _, err = h.Parse([]byte("Ho,st: localhost:42069\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidFieldName)
+
+	// Test: Control characters in values
+	for _, line := range []string{
+		"X-Test: a\rb\r\n\r\n",
+		"X-Test: a\nInjected: yes\r\n\r\n",
+		"X-Test: a\x00b\r\n\r\n",
+		"X-Test: a\x7fb\r\n\r\n",
+	} {
+		_, _, err = h.Parse([]byte(line))
+		assert.ErrorIs(t, err, ErrInvalidFieldValue, line)
+	}
+	assert.Equal(t, 0, h.Len())
+
+	// Test: Tabs and obs-text in values
+	n, _, err := h.Parse([]byte("X-Test: a\tb \xe9\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 15, n)
+	v, _ := h.Get("X-Test")
+	assert.Equal(t, "a\tb \xe9", v)
+
+	// Test: Obsolete line folding is rejected
+	h = NewHeaders()
+	_, _, err = h.Parse([]byte("X-Long: first\r\n"))
+	require.NoError(t, err)
+	_, _, err = h.Parse([]byte("  second\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrObsFold)
+	_, _, err = h.Parse([]byte("\tsecond\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrObsFold)
+
+	// Test: Obsolete line folding can be unfolded
+	h = NewHeaders()
+	_, _, err = h.ParseUnfolding([]byte("X-Long: first\r\n"))
+	require.NoError(t, err)
+	n, done, err := h.ParseUnfolding([]byte(" \t second \r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 12, n)
+	assert.False(t, done)
+	_, _, err = h.ParseUnfolding([]byte("  third\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first second third"}, h.Values("X-Long"))
+	assert.Equal(t, 1, h.Len())
+
+	// Test: Folded lines are validated too
+	_, _, err = h.ParseUnfolding([]byte(" a\x00b\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidFieldValue)
+}
@@ -0,0 +1,283 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrBodyClosed = errors.New("read on closed request body")
+
+// body streams a request's payload straight off the connection, decoding
+// chunked transfer coding as it goes. It is not safe to read from a body
+// concurrently with reading the next request.
+type body struct {
+	req    *Request
+	src    *Reader
+	closed bool
+	err    error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+	return b.read(p)
+}
+
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *body) read(p []byte) (int, error) {
+	for {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.req.State == requestStateDone {
+			return 0, io.EOF
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		prevState := b.req.State
+		consumed, n, err := b.req.parseBody(b.src.buf[:b.src.readToIndex], p)
+		b.src.discard(consumed)
+		if err != nil {
+			b.err = err
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if consumed > 0 || b.req.State != prevState {
+			continue
+		}
+
+		if remaining := b.req.payloadRemaining(); remaining > 0 && b.src.Buffered() == 0 {
+			// Nothing is buffered and payload comes next, so it is read
+			// straight into p rather than through the buffer.
+			n, err = b.src.src.Read(p[:min(len(p), remaining)])
+			if n > 0 {
+				b.req.parseBody(p[:n], p)
+				return n, nil
+			}
+		} else {
+			b.src.reserve(minBodyBufferSize)
+			_, err = b.src.fill()
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("incomplete request body, in state: %d: %w", b.req.State, io.ErrUnexpectedEOF)
+			}
+			b.err = err
+			return 0, err
+		}
+	}
+}
+
+// drain discards whatever the handler left unread so the connection is
+// positioned at the start of the next request.
+func (b *body) drain() error {
+	buf := make([]byte, 512)
+	for {
+		_, err := b.read(buf)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Request) prepareBody() error {
+	transferEncoding := strings.Join(r.Headers.Values("Transfer-Encoding"), ", ")
+	ok := r.Headers.Has("Transfer-Encoding")
+	if ok && r.RequestLine.HttpVersion == "1.0" {
+		// HTTP/1.0 has no transfer codings, so the body's framing can't be
+		// trusted.
+		return fmt.Errorf("%w: Transfer-Encoding in an HTTP/1.0 request", ErrMalformedRequest)
+	}
+	if ok && r.Headers.Has("Content-Length") {
+		// A message framed both ways could be read differently by another
+		// server in front of this one, so it's refused outright.
+		return fmt.Errorf("%w: both Transfer-Encoding and Content-Length", ErrMalformedRequest)
+	}
+	if ok {
+		if !isChunked(transferEncoding) {
+			return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, transferEncoding)
+		}
+		r.State = requestStateParseChunkSize
+		return nil
+	}
+
+	contentLenValues := r.Headers.Values("Content-Length")
+	if len(contentLenValues) == 0 {
+		r.State = requestStateDone
+		return nil
+	}
+	contentLen, err := parseContentLength(contentLenValues)
+	if err != nil {
+		return err
+	}
+	if r.opts.bodyTooLarge(int64(contentLen)) {
+		return fmt.Errorf("%w: Content-Length %d exceeds %d bytes", ErrPayloadTooLarge, contentLen, r.opts.MaxBodyBytes)
+	}
+
+	r.contentLength = contentLen
+	r.State = requestStateParseBody
+	if contentLen == 0 {
+		r.State = requestStateDone
+	}
+	return nil
+}
+
+// payloadRemaining returns how many payload bytes follow before the next
+// framing, or 0 if framing comes next.
+func (r *Request) payloadRemaining() int {
+	switch r.State {
+	case requestStateParseBody:
+		return r.contentLength - r.bodyLengthRead
+	case requestStateParseChunkData:
+		return r.chunkRemaining
+	default:
+		return 0
+	}
+}
+
+// parseBody consumes body framing and payload from data, copying payload
+// bytes into p. It returns how many bytes of data were consumed and how many
+// payload bytes were produced.
+func (r *Request) parseBody(data []byte, p []byte) (int, int, error) {
+	switch r.State {
+	case requestStateParseBody:
+		n := min(len(data), len(p), r.contentLength-r.bodyLengthRead)
+		copy(p, data[:n])
+		r.bodyLengthRead += n
+		if r.bodyLengthRead == r.contentLength {
+			r.State = requestStateDone
+		}
+		return n, n, nil
+	case requestStateParseChunkSize:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			if len(data) > maxChunkSizeLineBytes {
+				return 0, 0, fmt.Errorf("%w: chunk size line longer than %d bytes", ErrMalformedRequest, maxChunkSizeLineBytes)
+			}
+			return 0, 0, nil
+		}
+
+		chunkSize, err := parseChunkSize(data[:idx])
+		if err != nil {
+			return 0, 0, err
+		}
+		if r.opts.chunkTooLarge(int64(r.bodyLengthRead), int64(chunkSize)) {
+			return 0, 0, fmt.Errorf("%w: chunked body exceeds %d bytes", ErrPayloadTooLarge, r.opts.MaxBodyBytes)
+		}
+
+		if chunkSize == 0 {
+			r.State = requestStateParseTrailers
+		} else {
+			r.chunkRemaining = chunkSize
+			r.State = requestStateParseChunkData
+		}
+		return idx + 2, 0, nil
+	case requestStateParseChunkData:
+		n := min(len(data), len(p), r.chunkRemaining)
+		copy(p, data[:n])
+		r.bodyLengthRead += n
+		r.chunkRemaining -= n
+		if r.chunkRemaining == 0 {
+			r.State = requestStateParseChunkDataEnd
+		}
+		return n, n, nil
+	case requestStateParseChunkDataEnd:
+		if len(data) < len(crlf) {
+			return 0, 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte(crlf)) {
+			return 0, 0, fmt.Errorf("%w: missing CRLF after chunk data", ErrMalformedRequest)
+		}
+		r.State = requestStateParseChunkSize
+		return len(crlf), 0, nil
+	case requestStateParseTrailers:
+		n, done, err := r.parseFields(r.Trailers, data)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if done {
+			r.State = requestStateDone
+		}
+		return n, 0, nil
+	case requestStateDone:
+		return 0, 0, fmt.Errorf("error: trying to read data in a done state")
+	default:
+		return 0, 0, fmt.Errorf("error: unknown state")
+	}
+}
+
+// parseContentLength parses the Content-Length field lines of a request.
+// A length repeated on several lines, or as a list, is accepted only if
+// every copy agrees, so the body can't be framed two ways.
+func parseContentLength(values []string) (int, error) {
+	contentLen := -1
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			n, err := strconv.Atoi(v)
+			if err != nil || !allDigits(v, false) {
+				return 0, fmt.Errorf("%w: malformed Content-Length: %s", ErrMalformedRequest, value)
+			}
+			if contentLen >= 0 && n != contentLen {
+				return 0, fmt.Errorf("%w: conflicting Content-Length values: %s", ErrMalformedRequest, strings.Join(values, ", "))
+			}
+			contentLen = n
+		}
+	}
+	return contentLen, nil
+}
+
+// allDigits reports whether s is a non-empty run of decimal digits, or hex
+// digits if hex is set. strconv also accepts a sign, which a lenient proxy in
+// front of the server might frame differently.
+func allDigits(s string, hex bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isDigit := '0' <= c && c <= '9'
+		if hex {
+			isDigit = isDigit || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+		}
+		if !isDigit {
+			return false
+		}
+	}
+	return true
+}
+
+func isChunked(transferEncoding string) bool {
+	return strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked")
+}
+
+func parseChunkSize(line []byte) (int, error) {
+	sizeStr, _, _ := bytes.Cut(line, []byte(";"))
+	sizeStr = bytes.TrimRight(sizeStr, " \t")
+	if len(sizeStr) == 0 {
+		return 0, fmt.Errorf("%w: malformed chunk size: %q", ErrMalformedRequest, line)
+	}
+
+	size, err := strconv.ParseInt(string(sizeStr), 16, 64)
+	if err != nil || !allDigits(string(sizeStr), true) {
+		return 0, fmt.Errorf("%w: malformed chunk size: %q", ErrMalformedRequest, line)
+	}
+	return int(size), nil
+}
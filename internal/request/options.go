@@ -0,0 +1,57 @@
+package request
+
+const (
+	DefaultMaxRequestLineBytes = 8 << 10
+	DefaultMaxHeaderBytes      = 64 << 10
+	DefaultMaxHeaderCount      = 100
+	DefaultMaxBodyBytes        = 10 << 20
+)
+
+// maxChunkSizeLineBytes bounds a chunk-size line including its extensions.
+const maxChunkSizeLineBytes = 4 << 10
+
+// ParserOptions limits how much of a request the parser accepts before
+// giving up with ErrURITooLong, ErrHeaderFieldsTooLarge or
+// ErrPayloadTooLarge. Zero fields use the matching default.
+type ParserOptions struct {
+	// MaxRequestLineBytes caps the request line, excluding its CRLF.
+	MaxRequestLineBytes int
+	// MaxHeaderBytes caps the header section, and separately the trailer
+	// section of a chunked body.
+	MaxHeaderBytes int
+	// MaxHeaderCount caps the number of header (or trailer) field lines.
+	MaxHeaderCount int
+	// MaxBodyBytes caps the decoded body. A negative value disables the limit.
+	MaxBodyBytes int64
+	// UnfoldObsFold accepts header fields continued with obsolete line
+	// folding, replacing each fold with a space, instead of rejecting the
+	// request as malformed.
+	UnfoldObsFold bool
+}
+
+func (o ParserOptions) withDefaults() ParserOptions {
+	if o.MaxRequestLineBytes == 0 {
+		o.MaxRequestLineBytes = DefaultMaxRequestLineBytes
+	}
+	if o.MaxHeaderBytes == 0 {
+		o.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if o.MaxHeaderCount == 0 {
+		o.MaxHeaderCount = DefaultMaxHeaderCount
+	}
+	if o.MaxBodyBytes == 0 {
+		o.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return o
+}
+
+func (o ParserOptions) bodyTooLarge(n int64) bool {
+	return o.MaxBodyBytes >= 0 && n > o.MaxBodyBytes
+}
+
+// chunkTooLarge reports whether a chunk of size bytes would take a body
+// already read bytes long past the limit. The sum is never formed, so a huge
+// chunk size can't overflow it.
+func (o ParserOptions) chunkTooLarge(read, size int64) bool {
+	return o.MaxBodyBytes >= 0 && size > o.MaxBodyBytes-read
+}
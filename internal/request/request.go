@@ -2,11 +2,14 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"regexp"
-	"strconv"
 	"strings"
 
 	"github.com/sevaergdm/httpfromtcp/internal/headers"
@@ -15,15 +18,35 @@ import (
 type Request struct {
 	RequestLine RequestLine
 	State       requestState
-	Headers     headers.Headers
-	Body        []byte
+	Headers     *headers.Headers
+	Trailers    *headers.Headers
+	Body        io.ReadCloser
+	// URL is the request target with its path percent-decoded and dot
+	// segments removed.
+	URL *url.URL
+	// RemoteAddr is the address of the client that sent the request, if
+	// known.
+	RemoteAddr string
+	// TLS describes the connection the request arrived on, or is nil if it
+	// wasn't served over TLS.
+	TLS *tls.ConnectionState
+
+	ctx            context.Context
+	query          url.Values
+	pathValues     map[string]string
+	opts           ParserOptions
+	fieldBytes     int
+	fieldCount     int
+	contentLength  int
 	bodyLengthRead int
+	chunkRemaining int
 }
 
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
 	Method        string
+	TargetForm    TargetForm
 }
 
 type requestState int
@@ -33,59 +56,162 @@ const (
 	requestStateDone
 	requestStateParsingHeaders
 	requestStateParseBody
+	requestStateParseChunkSize
+	requestStateParseChunkData
+	requestStateParseChunkDataEnd
+	requestStateParseTrailers
 )
 
 const crlf = "\r\n"
 const bufferSize = 8
 
+// minBodyBufferSize is the smallest buffer a body is read through when it
+// can't be read straight into the caller's slice.
+const minBodyBufferSize = 4 << 10
+
 var ErrNeedMoreData = errors.New("need more data")
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+var (
+	ErrMalformedRequest            = errors.New("malformed request")
+	ErrUnsupportedVersion          = errors.New("unsupported http version")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+	ErrURITooLong                  = errors.New("request line too long")
+	ErrHeaderFieldsTooLarge        = errors.New("header fields too large")
+	ErrPayloadTooLarge             = errors.New("payload too large")
+	// ErrUnreadBody wraps an error met discarding the unread body of the
+	// previous request. It belongs to that request, whose response has
+	// already been sent, so it can't be answered.
+	ErrUnreadBody = errors.New("unable to discard unread request body")
+)
 
-	request := &Request{
-		State:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
-		Body: make([]byte, 0),
+// Reader reads consecutive requests from a single connection. Bytes read
+// past the end of one request are kept for the next, so pipelined requests
+// are not lost.
+type Reader struct {
+	src         io.Reader
+	buf         []byte
+	readToIndex int
+	body        *body
+	opts        ParserOptions
+}
+
+func NewReader(src io.Reader) *Reader {
+	return NewReaderWithOptions(src, ParserOptions{})
+}
+
+func NewReaderWithOptions(src io.Reader, opts ParserOptions) *Reader {
+	return &Reader{
+		src:  src,
+		buf:  make([]byte, bufferSize),
+		opts: opts.withDefaults(),
 	}
+}
 
-	for request.State != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, 2*len(buf))
-			copy(newBuf, buf)
-			buf = newBuf
-		}
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+func RequestFromReaderWithOptions(reader io.Reader, opts ParserOptions) (*Request, error) {
+	return NewReaderWithOptions(reader, opts).ReadRequest()
+}
 
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+// ReadRequest reads the next request line and headers from the connection,
+// returning before the body is read. Any unread body of the previous request
+// is discarded first. It returns io.EOF if the connection was closed cleanly
+// before any byte of a new request.
+func (cr *Reader) ReadRequest() (*Request, error) {
+	if cr.body != nil {
+		err := cr.body.drain()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if request.State != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", request.State, numBytesRead)
-				}
-				break
-			}
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrUnreadBody, err)
 		}
-		readToIndex += numBytesRead
+		cr.body = nil
+	}
 
-		numBytesParsed, err := request.parse(buf[:readToIndex])
+	request := &Request{
+		State:    requestStateInitialized,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		opts:     cr.opts,
+	}
+
+	for request.parsingHead() {
+		numBytesParsed, err := request.parse(cr.buf[:cr.readToIndex])
 		if err != nil {
 			return nil, err
 		}
+		cr.discard(numBytesParsed)
 
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+		if !request.parsingHead() {
+			break
+		}
+
+		numBytesRead, err := cr.fill()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			if request.State == requestStateInitialized && cr.readToIndex == 0 {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d: %w", request.State, numBytesRead, io.ErrUnexpectedEOF)
+		}
 	}
 
+	cr.body = &body{req: request, src: cr}
+	request.Body = cr.body
 	return request, nil
 }
 
-func parseRequestLine(data []byte) (*RequestLine, int, error) {
+// fill reads more data from the connection into the buffer, growing it if
+// it is full.
+func (cr *Reader) fill() (int, error) {
+	if cr.readToIndex >= len(cr.buf) {
+		newBuf := make([]byte, 2*len(cr.buf))
+		copy(newBuf, cr.buf)
+		cr.buf = newBuf
+	}
+
+	numBytesRead, err := cr.src.Read(cr.buf[cr.readToIndex:])
+	cr.readToIndex += numBytesRead
+	if numBytesRead > 0 && errors.Is(err, io.EOF) {
+		return numBytesRead, nil
+	}
+	return numBytesRead, err
+}
+
+// reserve grows the buffer to at least n bytes.
+func (cr *Reader) reserve(n int) {
+	if len(cr.buf) >= n {
+		return
+	}
+	newBuf := make([]byte, n)
+	copy(newBuf, cr.buf[:cr.readToIndex])
+	cr.buf = newBuf
+}
+
+func (cr *Reader) discard(n int) {
+	copy(cr.buf, cr.buf[n:cr.readToIndex])
+	cr.readToIndex -= n
+}
+
+// Buffered returns the number of bytes read from the connection that belong
+// to requests not yet returned by ReadRequest.
+func (cr *Reader) Buffered() int {
+	return cr.readToIndex
+}
+
+func parseRequestLine(data []byte, maxBytes int) (*RequestLine, int, error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
+		if len(data) > maxBytes {
+			return nil, 0, fmt.Errorf("%w: more than %d bytes", ErrURITooLong, maxBytes)
+		}
 		return nil, 0, nil
 	}
+	if idx > maxBytes {
+		return nil, 0, fmt.Errorf("%w: %d bytes", ErrURITooLong, idx)
+	}
 
 	requestLineText := string(data[:idx])
 	requestLine, err := requestLineFromString(requestLineText)
@@ -99,42 +225,52 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 func requestLineFromString(str string) (*RequestLine, error) {
 	parts := strings.Split(str, " ")
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("Invalid requestline: %s", str)
+		return nil, fmt.Errorf("%w: invalid request line: %s", ErrMalformedRequest, str)
 	}
 
 	method := parts[0]
 	var isUpperLetter = regexp.MustCompile(`^[A-Z]+$`).MatchString
 	if !isUpperLetter(method) {
-		return nil, fmt.Errorf("invalid method: %s", method)
+		return nil, fmt.Errorf("%w: invalid method: %s", ErrMalformedRequest, method)
 	}
 
 	requestTarget := parts[1]
 
 	versionParts := strings.Split(parts[2], "/")
 	if len(versionParts) != 2 {
-		return nil, fmt.Errorf("malformed start-line: %s", str)
+		return nil, fmt.Errorf("%w: malformed start-line: %s", ErrMalformedRequest, str)
 	}
 
 	httpPart := versionParts[0]
 	if httpPart != "HTTP" {
-		return nil, fmt.Errorf("Unrecognized http version: %s", httpPart)
+		return nil, fmt.Errorf("%w: unrecognized protocol: %s", ErrMalformedRequest, httpPart)
 	}
 
 	version := versionParts[1]
-	if version != "1.1" {
-		return nil, fmt.Errorf("Unrecognized http version: %s", version)
+	if version != "1.1" && version != "1.0" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
+	}
+
+	form, err := targetForm(requestTarget)
+	if err != nil {
+		return nil, err
 	}
 
 	return &RequestLine{
 		Method:        method,
 		RequestTarget: requestTarget,
 		HttpVersion:   version,
+		TargetForm:    form,
 	}, nil
 }
 
+func (r *Request) parsingHead() bool {
+	return r.State == requestStateInitialized || r.State == requestStateParsingHeaders
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
-	for r.State != requestStateDone {
+	for r.parsingHead() {
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
@@ -150,7 +286,7 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.State {
 	case requestStateInitialized:
-		requestLine, numBytes, err := parseRequestLine(data)
+		requestLine, numBytes, err := parseRequestLine(data, r.opts.MaxRequestLineBytes)
 		if err != nil {
 			return 0, err
 		}
@@ -159,42 +295,155 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, nil
 		}
 
+		r.URL, r.query, err = parseTarget(requestLine.RequestTarget, requestLine.TargetForm)
+		if err != nil {
+			return 0, err
+		}
 		r.RequestLine = *requestLine
 		r.State = requestStateParsingHeaders
 		return numBytes, nil
 	case requestStateParsingHeaders:
-		n, done, err := r.Headers.Parse(data)
+		n, done, err := r.parseFields(r.Headers, data)
 		if err != nil {
 			return 0, err
 		}
 
 		if done {
-			r.State = requestStateParseBody
+			r.fieldBytes = 0
+			r.fieldCount = 0
+			err = r.prepareBody()
+			if err != nil {
+				return 0, err
+			}
 		}
 		return n, nil
-	case requestStateParseBody:
-		contentLenStr, ok := r.Headers.Get("Content-Length")
-		if !ok {
-			r.State = requestStateDone
-			return len(data), nil
+	default:
+		return 0, fmt.Errorf("error: trying to parse head in state: %d", r.State)
+	}
+}
+
+// parseFields parses one header or trailer field line into h, enforcing the
+// size and count limits across the whole section.
+func (r *Request) parseFields(h *headers.Headers, data []byte) (int, bool, error) {
+	if r.fieldCount == 0 && len(data) > 0 && (data[0] == ' ' || data[0] == '\t') {
+		// Whitespace before the first field line could be read as folding it
+		// onto the line before, or be stripped by another server, so the
+		// field would be seen by only one of them (RFC 9112 section 2.2).
+		return 0, false, fmt.Errorf("%w: whitespace before first field line", ErrMalformedRequest)
+	}
+	parse := h.Parse
+	if r.opts.UnfoldObsFold {
+		parse = h.ParseUnfolding
+	}
+	n, done, err := parse(data)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %w", ErrMalformedRequest, err)
+	}
+
+	if n == 0 {
+		if r.fieldBytes+len(data) > r.opts.MaxHeaderBytes {
+			return 0, false, fmt.Errorf("%w: more than %d bytes", ErrHeaderFieldsTooLarge, r.opts.MaxHeaderBytes)
 		}
-		contentLen, err := strconv.Atoi(contentLenStr)
-		if err != nil {
-			return 0, fmt.Errorf("malformed Content-Length: %s", err)
+		return 0, false, nil
+	}
+
+	r.fieldBytes += n
+	if r.fieldBytes > r.opts.MaxHeaderBytes {
+		return 0, false, fmt.Errorf("%w: more than %d bytes", ErrHeaderFieldsTooLarge, r.opts.MaxHeaderBytes)
+	}
+	if !done {
+		r.fieldCount++
+		if r.fieldCount > r.opts.MaxHeaderCount {
+			return 0, false, fmt.Errorf("%w: more than %d fields", ErrHeaderFieldsTooLarge, r.opts.MaxHeaderCount)
 		}
+	}
+	return n, done, nil
+}
 
-		r.Body = append(r.Body, data...)
-		r.bodyLengthRead += len(data)
-		if  r.bodyLengthRead > contentLen {
-			return 0, fmt.Errorf("Content-Length too large")
+// BodyBytes reads the rest of the body into memory. The body remains
+// readable from the start afterwards, so it is safe to call more than once.
+func (r *Request) BodyBytes() ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// Query returns the decoded query parameters of the request target.
+func (r *Request) Query() url.Values {
+	return r.query
+}
+
+// Context returns the request's context. For requests served by
+// server.Server it is cancelled when the client disconnects, the response
+// times out or the server shuts down.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// which middleware can use to attach values for the handlers it wraps.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
+// BodyComplete reports whether the whole body has been read off the
+// connection. It is true from the start for requests without a body.
+func (r *Request) BodyComplete() bool {
+	b, ok := r.Body.(*body)
+	if !ok {
+		return true
+	}
+	return b.req.State == requestStateDone
+}
+
+// ClientCertificate returns the certificate the client authenticated with,
+// or nil if it didn't present one that was verified.
+func (r *Request) ClientCertificate() *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// PathValue returns the value a router captured for the named path
+// parameter, or "" if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
+// KeepAlive reports whether the client wants the connection kept open.
+// HTTP/1.1 connections persist unless "Connection: close" is sent, HTTP/1.0
+// ones only if "Connection: keep-alive" is.
+func (r *Request) KeepAlive() bool {
+	connection := strings.Join(r.Headers.Values("Connection"), ",")
+	keepAlive := r.RequestLine.HttpVersion != "1.0"
+	for _, token := range strings.Split(connection, ",") {
+		token = strings.TrimSpace(token)
+		if strings.EqualFold(token, "close") {
+			return false
 		}
-		if r.bodyLengthRead == contentLen {
-			r.State = requestStateDone
+		if strings.EqualFold(token, "keep-alive") {
+			keepAlive = true
 		}
-		return len(data), nil
-	case requestStateDone:
-		return 0, fmt.Errorf("error: trying to read data in a done state")
-	default:
-		return 0, fmt.Errorf("error: unknown state")
 	}
+	return keepAlive
 }
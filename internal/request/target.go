@@ -0,0 +1,159 @@
+package request
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TargetForm is the form of a request target, as RFC 9112 section 3.2
+// defines them.
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path and optional query, as in
+	// "GET /where?q=now". It's the form used for most requests.
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a complete URI, as in
+	// "GET http://www.example.org/pub/WWW/". Clients send it to proxies.
+	AbsoluteForm
+	// AuthorityForm is a host and port, as in "CONNECT www.example.com:80".
+	// It's only used with CONNECT.
+	AuthorityForm
+	// AsteriskForm is "*", as in "OPTIONS *". It's only used with OPTIONS.
+	AsteriskForm
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case OriginForm:
+		return "origin-form"
+	case AbsoluteForm:
+		return "absolute-form"
+	case AuthorityForm:
+		return "authority-form"
+	case AsteriskForm:
+		return "asterisk-form"
+	default:
+		return "TargetForm(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// targetForm recognizes the form of a request target.
+func targetForm(target string) (TargetForm, error) {
+	switch {
+	case target == "*":
+		return AsteriskForm, nil
+	case strings.HasPrefix(target, "/"):
+		return OriginForm, nil
+	case strings.Contains(target, "://"):
+		return AbsoluteForm, nil
+	case validAuthority(target):
+		return AuthorityForm, nil
+	default:
+		return 0, fmt.Errorf("%w: invalid request target: %q", ErrMalformedRequest, target)
+	}
+}
+
+// validAuthority reports whether target is a host and port with nothing
+// else, as the authority-form requires.
+func validAuthority(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" || strings.ContainsAny(host, "@/?#%") {
+		return false
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n > 0
+}
+
+// parseTarget parses a request target of the given form into a URL and
+// decodes its query. Paths are percent-decoded with dot segments removed,
+// and invalid percent-encodings are rejected. Fragments, which clients
+// shouldn't send, are dropped.
+func parseTarget(target string, form TargetForm) (*url.URL, url.Values, error) {
+	switch form {
+	case AsteriskForm:
+		return &url.URL{Path: "*"}, url.Values{}, nil
+	case AuthorityForm:
+		return &url.URL{Host: target}, url.Values{}, nil
+	}
+
+	target, _, _ = strings.Cut(target, "#")
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid request target: %w", ErrMalformedRequest, err)
+	}
+	if form == AbsoluteForm {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, nil, fmt.Errorf("%w: unsupported scheme in request target: %q", ErrMalformedRequest, u.Scheme)
+		}
+		if u.Host == "" || u.User != nil {
+			return nil, nil, fmt.Errorf("%w: invalid authority in request target: %q", ErrMalformedRequest, target)
+		}
+		// An empty path in the absolute-form stands for the root.
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+
+	if strings.HasPrefix(u.Path, "/") {
+		escaped := removeDotSegments(u.EscapedPath())
+		u.Path, err = url.PathUnescape(escaped)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid request target: %w", ErrMalformedRequest, err)
+		}
+		u.RawPath = ""
+		if u.EscapedPath() != escaped {
+			u.RawPath = escaped
+		}
+	}
+
+	_, err = url.QueryUnescape(u.RawQuery)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid query: %w", ErrMalformedRequest, err)
+	}
+	// With the escapes known to be valid, ParseQuery can only fail on a
+	// semicolon separator. The pair holding it is dropped, as net/http
+	// does, and the rest are kept.
+	query, _ := url.ParseQuery(u.RawQuery)
+	return u, query, nil
+}
+
+// removeDotSegments resolves the "." and ".." segments of an escaped
+// absolute path as RFC 3986 section 5.2.4 describes, including
+// percent-encoded ones. ".." never climbs above the root.
+func removeDotSegments(path string) string {
+	segments := strings.Split(path[1:], "/")
+	out := make([]string, 0, len(segments))
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch dotSegment(seg) {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, seg)
+			continue
+		}
+		// A trailing dot segment still names a directory.
+		if last {
+			out = append(out, "")
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
+
+func dotSegment(seg string) string {
+	if len(seg) == 0 || len(seg) > len("%2e%2e") {
+		return ""
+	}
+	s, err := url.PathUnescape(seg)
+	if err != nil || (s != "." && s != "..") {
+		return ""
+	}
+	return s
+}
@@ -3,6 +3,9 @@ package response
 import (
 	"fmt"
 	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
 
 	"github.com/sevaergdm/httpfromtcp/internal/headers"
 )
@@ -20,67 +23,224 @@ const (
 )
 
 type Writer struct {
-	dst   io.Writer
-	stage writerStage
+	dst          io.Writer
+	stage        writerStage
+	formatError  ErrorFormatter
+	headerHooks  []func(StatusCode, *headers.Headers)
+	statusCode   StatusCode
+	header       *headers.Headers
+	version      string
+	method       string
+	preserveCase bool
+	keepAlive    bool
+	aborted      bool
+	chunked      bool
+	// closeDelimited is set when a chunked body can't be sent to an HTTP/1.0
+	// client, so it is written as is and ends when the connection closes.
+	closeDelimited bool
+	// noBody is set for responses that never have a body, such as those to
+	// HEAD requests. Body writes to them are discarded.
+	noBody        bool
+	contentLength int
+	bodyWritten   int
 }
 
-type StatusCode int
+// ErrorFormatter renders the body of an error response written with
+// WriteError.
+type ErrorFormatter func(statusCode StatusCode, message string) (contentType string, body []byte)
 
-const (
-	OK                  StatusCode = 200
-	BadRequest          StatusCode = 400
-	InternalServerError StatusCode = 500
-)
+func DefaultErrorFormatter(statusCode StatusCode, message string) (string, []byte) {
+	body := statusCode.String() + "\n"
+	if message != "" {
+		body += message + "\n"
+	}
+	return "text/plain", []byte(body)
+}
 
 const crlf = "\r\n"
 
 func NewWriter(dst io.Writer) *Writer {
-	return &Writer{dst: dst, stage: stageStart}
+	return &Writer{
+		dst:           dst,
+		stage:         stageStart,
+		formatError:   DefaultErrorFormatter,
+		version:       "1.1",
+		contentLength: -1,
+	}
+}
+
+// SetHTTPVersion sets the version written in the status line, "1.1" or
+// "1.0", to match the request's. HTTP/1.0 responses are never chunked: a
+// chunked body is sent as is, delimited by closing the connection, and its
+// trailers are dropped. It must be called before WriteStatusLine.
+func (w *Writer) SetHTTPVersion(version string) {
+	w.version = version
+}
+
+// SetErrorFormatter changes how WriteError renders error bodies. A nil
+// formatter restores DefaultErrorFormatter.
+func (w *Writer) SetErrorFormatter(f ErrorFormatter) {
+	if f == nil {
+		f = DefaultErrorFormatter
+	}
+	w.formatError = f
+}
+
+// SetRequestMethod tells the writer the method of the request it answers.
+// Responses to HEAD keep their headers, including Content-Length, but their
+// body is discarded. It must be called before WriteHeaders.
+func (w *Writer) SetRequestMethod(method string) {
+	w.method = method
+}
+
+// SetPreserveHeaderCase makes the writer send header and trailer names in
+// the case they were added with, for clients that expect a particular
+// spelling. By default names are sent in canonical form, such as
+// "Content-Type".
+func (w *Writer) SetPreserveHeaderCase(preserve bool) {
+	w.preserveCase = preserve
+}
+
+// SetKeepAlive controls whether the response offers to keep the connection
+// open. It must be called before WriteHeaders to have any effect.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// Started reports whether any part of the response has been written.
+func (w *Writer) Started() bool {
+	return w.stage != stageStart
+}
+
+// OnWriteHeaders registers fn to run just before the headers are written,
+// letting middleware inspect or add to them. Hooks run in the order they
+// were registered.
+func (w *Writer) OnWriteHeaders(fn func(statusCode StatusCode, h *headers.Headers)) {
+	w.headerHooks = append(w.headerHooks, fn)
+}
+
+// Status returns the status code written, or 0 if the status line hasn't
+// been written yet.
+func (w *Writer) Status() StatusCode {
+	return w.statusCode
+}
+
+// Header returns the headers as they were written, or nil if they haven't
+// been written yet.
+func (w *Writer) Header() *headers.Headers {
+	return w.header
+}
+
+// BytesWritten returns the number of body bytes written so far, not counting
+// chunked framing.
+func (w *Writer) BytesWritten() int {
+	return w.bodyWritten
+}
+
+// Abort marks a partially written response as failed. Finish will leave it
+// incomplete so the client can tell it was cut short, and the connection
+// will not be reused.
+func (w *Writer) Abort() {
+	w.aborted = true
+	w.keepAlive = false
+}
+
+// KeepAlive reports whether the connection can be reused once the response
+// has been finished.
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineWithReason(statusCode, statusCode.Text())
+}
+
+// WriteStatusLineWithReason writes a status line with a custom reason
+// phrase in place of the registered one.
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
 	if w.stage != stageStart {
 		return fmt.Errorf("status line must be first; current stage=%v", w.stage)
 	}
-
-	var line string
-	switch statusCode {
-	case OK:
-		line = "HTTP/1.1 200 OK\r\n"
-	case BadRequest:
-		line = "HTTP/1.1 400 Bad Request\r\n"
-	case InternalServerError:
-		line = "HTTP/1.1 500 Internal Server Error\r\n"
-	default:
-		line = fmt.Sprintf("HTTP/1.1 %d \r\n", statusCode)
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("invalid status code: %d", statusCode)
 	}
+	if !validReasonPhrase(reason) {
+		return fmt.Errorf("invalid reason phrase: %q", reason)
+	}
+
+	line := fmt.Sprintf("HTTP/%s %d %s\r\n", w.version, statusCode, reason)
 	_, err := w.dst.Write([]byte(line))
 	if err != nil {
 		return err
 	}
+	w.statusCode = statusCode
 	w.stage = stageStatusWritten
 	return nil
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+// WriteError writes a complete response for statusCode whose body is
+// rendered by the writer's ErrorFormatter.
+func (w *Writer) WriteError(statusCode StatusCode, message string) error {
+	return w.WriteErrorWithHeaders(statusCode, message, nil)
+}
+
+// WriteErrorWithHeaders is like WriteError but also sends the fields in h,
+// such as the Allow header of a 405 response.
+func (w *Writer) WriteErrorWithHeaders(statusCode StatusCode, message string, h *headers.Headers) error {
+	contentType, body := w.formatError(statusCode, message)
+
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		return err
+	}
+
+	header := GetDefaultHeaders(len(body))
+	header.Set("Content-Type", contentType)
+	for name := range h.All() {
+		header.Del(name)
+	}
+	for name, value := range h.All() {
+		header.Add(name, value)
+	}
+	err = w.WriteHeaders(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.WriteBody(body)
+	return err
+}
+
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	header := headers.NewHeaders()
 	header.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	header.Set("Connection", "close")
 	header.Set("Content-Type", "text/plain")
 	return header
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
 	if w.stage != stageStatusWritten {
 		return fmt.Errorf("headers must be after status line; current stage=%v", w.stage)
 	}
-	for k, v := range headers {
-		_, err := w.dst.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	for _, hook := range w.headerHooks {
+		hook(w.statusCode, h)
+	}
+	err := validateFields(h)
+	if err != nil {
+		return err
+	}
+	w.prepareHeaders(h)
+	w.header = h
+	for name, value := range h.All() {
+		_, err := w.dst.Write([]byte(fmt.Sprintf("%s: %s\r\n", w.fieldName(name), value)))
 		if err != nil {
 			return err
 		}
 	}
-	_, err := w.dst.Write([]byte("\r\n"))
+	_, err = w.dst.Write([]byte("\r\n"))
 	w.stage = stageHeadersWritten
 	return err
 }
@@ -89,7 +249,12 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.stage != stageHeadersWritten && w.stage != stageBodyWriting {
 		return 0, fmt.Errorf("body must be after headers; current stage=%v", w.stage)
 	}
+	if w.noBody {
+		w.stage = stageBodyWritten
+		return len(p), nil
+	}
 	n, err := w.dst.Write(p)
+	w.bodyWritten += n
 	if err == nil {
 		w.stage = stageBodyWritten
 	}
@@ -101,6 +266,19 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("body must be after headers; current stage=%v", w.stage)
 	}
 
+	if w.noBody {
+		w.stage = stageBodyWriting
+		return len(p), nil
+	}
+	if w.closeDelimited {
+		n, err := w.dst.Write(p)
+		w.bodyWritten += n
+		if err == nil {
+			w.stage = stageBodyWriting
+		}
+		return n, err
+	}
+
 	chunkSize := fmt.Sprintf("%x", len(p))
 
 	_, err := w.dst.Write([]byte(chunkSize))
@@ -114,6 +292,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	}
 
 	n, err := w.dst.Write(p)
+	w.bodyWritten += n
 	if err != nil {
 		return n, err
 	}
@@ -131,6 +310,10 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.stage != stageBodyWriting && w.stage != stageHeadersWritten {
 		return 0, fmt.Errorf("body must be after headers; current stage=%v", w.stage)
 	}
+	if w.closeDelimited || w.noBody {
+		w.stage = stageBodyWrittenDone
+		return 0, nil
+	}
 	totalBytes := 0
 	n, err := w.dst.Write([]byte("0"))
 	if err != nil {
@@ -149,18 +332,26 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	return totalBytes, nil
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
 	if w.stage != stageBodyWrittenDone {
 		return fmt.Errorf("trailers must be written after body is done; current stage=%v", w.stage)
 	}
+	if w.closeDelimited || w.noBody {
+		w.stage = stageTrailersWritten
+		return nil
+	}
+	err := validateFields(h)
+	if err != nil {
+		return err
+	}
 
-	for k, v := range h {
-		_, err := w.dst.Write([]byte(fmt.Sprintf("%s: %s%s", k, v, crlf)))
+	for name, value := range h.All() {
+		_, err := w.dst.Write([]byte(fmt.Sprintf("%s: %s%s", w.fieldName(name), value, crlf)))
 		if err != nil {
 			return fmt.Errorf("Unable to write trailers: %v", err)
 		}
 	}
-	_, err := w.dst.Write([]byte(crlf))
+	_, err = w.dst.Write([]byte(crlf))
 	if err != nil {
 		return fmt.Errorf("Unable to write closing crlf: %v", err)
 	}
@@ -168,3 +359,90 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	w.stage = stageTrailersWritten
 	return nil
 }
+
+// Finish completes a response the handler left open, such as a chunked body
+// without its terminating chunk. If the response cannot be completed in a way
+// the client can delimit, the connection is marked as not reusable.
+func (w *Writer) Finish() error {
+	if w.aborted {
+		return nil
+	}
+	if w.chunked && (w.stage == stageHeadersWritten || w.stage == stageBodyWriting) {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
+	if w.stage == stageBodyWrittenDone {
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+
+	if w.stage < stageHeadersWritten {
+		w.keepAlive = false
+	}
+	if !w.noBody && !w.chunked && w.contentLength >= 0 && w.bodyWritten != w.contentLength {
+		w.keepAlive = false
+	}
+	return nil
+}
+
+// validateFields rejects fields that can't be written as they are, such as a
+// value with a line break injected into it to add fields of its own.
+func validateFields(h *headers.Headers) error {
+	for name, value := range h.All() {
+		if !headers.ValidFieldName(name) {
+			return fmt.Errorf("%w: %q", headers.ErrInvalidFieldName, name)
+		}
+		if !headers.ValidFieldValue(value) {
+			return fmt.Errorf("%w for %s: %q", headers.ErrInvalidFieldValue, name, value)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) fieldName(name string) string {
+	if w.preserveCase {
+		return name
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+func (w *Writer) prepareHeaders(h *headers.Headers) {
+	w.noBody = w.method == "HEAD" || w.statusCode == NoContent || w.statusCode == NotModified || w.statusCode.IsInformational()
+
+	transferEncoding, _ := h.Get("Transfer-Encoding")
+	w.chunked = strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked")
+	if w.version == "1.0" {
+		// HTTP/1.0 has no transfer codings, so they are never sent to it,
+		// even in a response without a body.
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+		if w.chunked && !w.noBody {
+			w.closeDelimited = true
+			w.keepAlive = false
+		}
+		w.chunked = false
+	}
+
+	if contentLenStr, ok := h.Get("Content-Length"); ok && !w.chunked {
+		contentLen, err := strconv.Atoi(contentLenStr)
+		if err != nil {
+			w.keepAlive = false
+		} else {
+			w.contentLength = contentLen
+		}
+	} else if !w.chunked && !w.noBody {
+		w.keepAlive = false
+	}
+
+	for _, connection := range h.Values("Connection") {
+		if strings.EqualFold(connection, "close") {
+			w.keepAlive = false
+		}
+	}
+	if !w.keepAlive {
+		h.Set("Connection", "close")
+	} else if w.version == "1.0" {
+		// HTTP/1.0 connections only persist when both sides ask.
+		h.Set("Connection", "keep-alive")
+	}
+}
@@ -0,0 +1,288 @@
+package response
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/headers"
+	"github.com/sevaergdm/httpfromtcp/internal/response/responsetest"
+)
+
+func TestHTTP10Writer(t *testing.T) {
+	// Test: Status line echoes the request's version
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetHTTPVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(OK))
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n", buf.String())
+
+	// Test: Persistent connections are announced explicitly
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetHTTPVersion("1.0")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err := w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked bodies fall back to close-delimited ones
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetHTTPVersion("1.0")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello, "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nhello, world", buf.String())
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, 12, w.BytesWritten())
+
+	// Test: Unfinished chunked bodies are left to the connection close
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetHTTPVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("partial"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\npartial", buf.String())
+}
+
+func TestHeaderOutput(t *testing.T) {
+	newHeaders := func() *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("content-type", "text/plain")
+		h.Add("x-request-ID", "7")
+		h.Add("Set-Cookie", "a=1")
+		h.Add("set-cookie", "b=2")
+		h.Set("CONTENT-LENGTH", "0")
+		return h
+	}
+
+	// Test: Names are canonicalized and written in the order they were added
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(NoContent))
+	require.NoError(t, w.WriteHeaders(newHeaders()))
+	responsetest.AssertWire(t, []byte("HTTP/1.1 204 No Content\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"X-Request-Id: 7\r\n"+
+		"Set-Cookie: a=1\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"Content-Length: 0\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"), buf.Bytes())
+
+	// Test: Case can be preserved
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetPreserveHeaderCase(true)
+	require.NoError(t, w.WriteStatusLine(NoContent))
+	require.NoError(t, w.WriteHeaders(newHeaders()))
+	responsetest.AssertWire(t, []byte("HTTP/1.1 204 No Content\r\n"+
+		"content-type: text/plain\r\n"+
+		"x-request-ID: 7\r\n"+
+		"Set-Cookie: a=1\r\n"+
+		"set-cookie: b=2\r\n"+
+		"CONTENT-LENGTH: 0\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"), buf.Bytes())
+
+	// Test: Output is the same every time
+	first := buf.String()
+	for range 20 {
+		buf.Reset()
+		w = NewWriter(&buf)
+		w.SetPreserveHeaderCase(true)
+		require.NoError(t, w.WriteStatusLine(NoContent))
+		require.NoError(t, w.WriteHeaders(newHeaders()))
+		require.Equal(t, first, buf.String())
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	// Test: Values with line breaks are refused before anything is written
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := GetDefaultHeaders(0)
+	h.Set("Location", "/next\r\nSet-Cookie: session=stolen")
+	err := w.WriteHeaders(h)
+	assert.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	assert.Nil(t, w.Header())
+
+	// Test: Values set by header hooks are checked too
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.OnWriteHeaders(func(_ StatusCode, h *headers.Headers) {
+		h.Set("X-Hooked", "a\x00b")
+	})
+	require.NoError(t, w.WriteStatusLine(OK))
+	err = w.WriteHeaders(GetDefaultHeaders(0))
+	assert.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+
+	// Test: Invalid names are refused
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = GetDefaultHeaders(0)
+	h.Add("Bad Name", "x")
+	assert.ErrorIs(t, w.WriteHeaders(h), headers.ErrInvalidFieldName)
+
+	// Test: Trailers are checked too
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc\nX-Injected: yes")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), headers.ErrInvalidFieldValue)
+	assert.NotContains(t, buf.String(), "X-Injected")
+}
+
+func TestGoldenResponses(t *testing.T) {
+	for name, write := range map[string]func(w *Writer) error{
+		"text": func(w *Writer) error {
+			w.SetKeepAlive(true)
+			err := w.WriteStatusLine(OK)
+			if err == nil {
+				err = w.WriteHeaders(GetDefaultHeaders(len("hello\n")))
+			}
+			if err == nil {
+				_, err = w.WriteBody([]byte("hello\n"))
+			}
+			return err
+		},
+		"error": func(w *Writer) error {
+			h := headers.NewHeaders()
+			h.Set("allow", "GET, HEAD")
+			return w.WriteErrorWithHeaders(MethodNotAllowed, "", h)
+		},
+		"chunked": func(w *Writer) error {
+			w.SetKeepAlive(true)
+			err := w.WriteStatusLine(OK)
+			h := headers.NewHeaders()
+			h.Set("transfer-encoding", "chunked")
+			h.Set("trailer", "x-checksum")
+			if err == nil {
+				err = w.WriteHeaders(h)
+			}
+			if err == nil {
+				_, err = w.WriteChunkedBody([]byte("hello, world"))
+			}
+			if err == nil {
+				_, err = w.WriteChunkedBodyDone()
+			}
+			trailers := headers.NewHeaders()
+			trailers.Set("x-checksum", "abc123")
+			if err == nil {
+				err = w.WriteTrailers(trailers)
+			}
+			return err
+		},
+		"http10": func(w *Writer) error {
+			w.SetHTTPVersion("1.0")
+			w.SetKeepAlive(true)
+			err := w.WriteStatusLine(OK)
+			if err == nil {
+				err = w.WriteHeaders(GetDefaultHeaders(0))
+			}
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, write(NewWriter(&buf)))
+			responsetest.AssertGolden(t, filepath.Join("testdata", name+".golden"), buf.Bytes())
+		})
+	}
+}
+
+func TestNoBodyResponses(t *testing.T) {
+	// Test: HEAD responses keep their headers but drop the body
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	responsetest.AssertWire(t, []byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\n"), buf.Bytes())
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, 0, w.BytesWritten())
+
+	// Test: Chunked HEAD responses send no chunks or trailers
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	responsetest.AssertWire(t, []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"), buf.Bytes())
+	assert.True(t, w.KeepAlive())
+
+	// Test: HTTP/1.0 HEAD responses drop chunked framing but stay keep-alive
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetHTTPVersion("1.0")
+	w.SetRequestMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	responsetest.AssertWire(t, []byte("HTTP/1.0 200 OK\r\nConnection: keep-alive\r\n\r\n"), buf.Bytes())
+	assert.True(t, w.KeepAlive())
+
+	// Test: 204 and 304 responses never have a body
+	for _, status := range []StatusCode{NoContent, NotModified} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		w.SetKeepAlive(true)
+		require.NoError(t, w.WriteStatusLine(status))
+		require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+		_, err = w.WriteBody([]byte("ignored"))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.NotContains(t, buf.String(), "ignored", status)
+		assert.True(t, w.KeepAlive(), status)
+	}
+}
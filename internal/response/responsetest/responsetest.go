@@ -0,0 +1,70 @@
+// Package responsetest compares raw HTTP responses byte for byte in tests.
+package responsetest
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the output the tests produce")
+
+// AssertWire reports a test error unless got is exactly want. The failure
+// message quotes the first line that differs, so stray whitespace and
+// missing carriage returns are visible.
+func AssertWire(t testing.TB, want, got []byte) bool {
+	t.Helper()
+	if bytes.Equal(want, got) {
+		return true
+	}
+
+	wantLines, gotLines := splitLines(want), splitLines(got)
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		wantLine, gotLine := line(wantLines, i), line(gotLines, i)
+		if wantLine != gotLine {
+			t.Errorf("response differs at line %d:\nwant %s\ngot  %s\n\nfull response:\n%s", i+1, wantLine, gotLine, strconv.Quote(string(got)))
+			return false
+		}
+	}
+	return true
+}
+
+// AssertGolden compares got with the golden file at path as AssertWire
+// does. Running the tests with -update writes got to the file instead.
+func AssertGolden(t testing.TB, path string, got []byte) bool {
+	t.Helper()
+	if *update {
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, got, 0o644)
+		}
+		if err != nil {
+			t.Fatalf("unable to update golden file: %v", err)
+		}
+		return true
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read golden file: %v", err)
+	}
+	return AssertWire(t, want, got)
+}
+
+func splitLines(b []byte) [][]byte {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func line(lines [][]byte, i int) string {
+	if i >= len(lines) {
+		return "<end of response>"
+	}
+	return strconv.Quote(string(lines[i]))
+}
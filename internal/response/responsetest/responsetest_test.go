@@ -0,0 +1,55 @@
+package responsetest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingT captures the failures reported through it.
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertWire(t *testing.T) {
+	// Test: Identical responses pass
+	rt := &recordingT{TB: t}
+	assert.True(t, AssertWire(rt, []byte("HTTP/1.1 200 OK\r\n\r\n"), []byte("HTTP/1.1 200 OK\r\n\r\n")))
+	assert.Empty(t, rt.errors)
+
+	// Test: The first differing line is quoted
+	rt = &recordingT{TB: t}
+	assert.False(t, AssertWire(rt, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\n\r\n")))
+	assert.Len(t, rt.errors, 1)
+	assert.Contains(t, rt.errors[0], "line 2")
+	assert.Contains(t, rt.errors[0], `want "Content-Length: 0\r\n"`)
+	assert.Contains(t, rt.errors[0], `got  "Content-Length: 0\n"`)
+
+	// Test: Truncated output
+	rt = &recordingT{TB: t}
+	assert.False(t, AssertWire(rt, []byte("HTTP/1.1 200 OK\r\n\r\nbody"), []byte("HTTP/1.1 200 OK\r\n")))
+	assert.Contains(t, rt.errors[0], "<end of response>")
+}
+
+func TestAssertGolden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ok.golden")
+	assert.NoError(t, os.WriteFile(path, []byte("HTTP/1.1 204 No Content\r\n\r\n"), 0o644))
+
+	// Test: Output matching the golden file passes
+	rt := &recordingT{TB: t}
+	assert.True(t, AssertGolden(rt, path, []byte("HTTP/1.1 204 No Content\r\n\r\n")))
+
+	// Test: Output differing from the golden file fails
+	assert.False(t, AssertGolden(rt, path, []byte("HTTP/1.1 200 OK\r\n\r\n")))
+	assert.Len(t, rt.errors, 1)
+}
@@ -0,0 +1,57 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCode(t *testing.T) {
+	// Test: Registered code
+	assert.Equal(t, "Not Found", NotFound.Text())
+	assert.Equal(t, "404 Not Found", NotFound.String())
+	assert.True(t, NotFound.IsClientError())
+	assert.False(t, NotFound.IsServerError())
+
+	// Test: Unregistered code
+	assert.Equal(t, "", StatusCode(299).Text())
+	assert.Equal(t, "299", StatusCode(299).String())
+	assert.True(t, StatusCode(299).IsSuccess())
+
+	// Test: Classification
+	assert.True(t, Continue.IsInformational())
+	assert.True(t, PermanentRedirect.IsRedirect())
+	assert.True(t, NetworkAuthenticationRequired.IsServerError())
+}
+
+func TestWriteStatusLine(t *testing.T) {
+	// Test: Registered reason phrase
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", buf.String())
+
+	// Test: Unregistered code has an empty reason phrase
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCode(299)))
+	assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+
+	// Test: Custom reason phrase
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLineWithReason(OK, "Totally Fine"))
+	assert.Equal(t, "HTTP/1.1 200 Totally Fine\r\n", buf.String())
+
+	// Test: Reason phrase with a line break
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteStatusLineWithReason(OK, "Fine\r\nX-Injected: yes"))
+	assert.Equal(t, "", buf.String())
+
+	// Test: Out of range code
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteStatusLine(StatusCode(42)))
+}
@@ -0,0 +1,283 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sevaergdm/httpfromtcp/internal/headers"
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+	"github.com/sevaergdm/httpfromtcp/internal/server"
+)
+
+type segmentKind int
+
+// Segment kinds are ordered by precedence: a literal segment beats a
+// parameter, which beats a wildcard.
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the literal text, or the parameter name for the other kinds.
+	value string
+}
+
+type route struct {
+	pattern  string
+	method   string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to the handler whose pattern best matches the
+// request's method and path.
+//
+// A pattern is an optional method followed by a path, such as
+// "GET /users/{id}" or "/static/{path...}". In the path, {name} matches one
+// non-empty segment and {name...} or a trailing * matches the rest of the
+// path. When several patterns match, the one with a literal segment where
+// the other has a parameter, or a parameter where the other has a wildcard,
+// wins, comparing segments left to right; a pattern naming the method beats
+// one that doesn't. A GET pattern also matches HEAD requests.
+type Router struct {
+	routes []*route
+}
+
+var isMethod = regexp.MustCompile(`^[A-Z]+$`).MatchString
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for pattern. It panics if the pattern is invalid
+// or another route was already registered for it.
+func (rt *Router) Handle(pattern string, handler server.Handler) {
+	newRoute, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("router: %v", err))
+	}
+	for _, existing := range rt.routes {
+		if existing.method == newRoute.method && sameSegments(existing.segments, newRoute.segments) {
+			panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, existing.pattern))
+		}
+	}
+
+	newRoute.handler = handler
+	rt.routes = append(rt.routes, newRoute)
+}
+
+func (rt *Router) HandleFunc(pattern string, handler server.HandlerFunc) {
+	rt.Handle(pattern, server.HandleErrors(handler))
+}
+
+// Serve is a server.Handler that routes the request. Requests whose path
+// matches no pattern get a 404; requests whose path matches only patterns
+// for other methods get a 405 with an Allow header.
+func (rt *Router) Serve(w *response.Writer, r *request.Request) {
+	method := r.RequestLine.Method
+	path := requestPath(r)
+
+	var best *route
+	var bestValues map[string]string
+	allowed := make(map[string]bool)
+	for _, candidate := range rt.routes {
+		values, ok := candidate.match(path)
+		if !ok {
+			continue
+		}
+		if methodRank(candidate.method, method) < 0 {
+			allowed[candidate.method] = true
+			if candidate.method == "GET" {
+				allowed["HEAD"] = true
+			}
+			continue
+		}
+		if best == nil || candidate.precedes(best, method) {
+			best = candidate
+			bestValues = values
+		}
+	}
+
+	if best == nil {
+		writeNoRoute(w, allowed)
+		return
+	}
+
+	for name, value := range bestValues {
+		r.SetPathValue(name, value)
+	}
+	best.handler(w, r)
+}
+
+func writeNoRoute(w *response.Writer, allowed map[string]bool) {
+	if len(allowed) == 0 {
+		w.WriteError(response.NotFound, "")
+		return
+	}
+
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	header := headers.NewHeaders()
+	header.Set("Allow", strings.Join(methods, ", "))
+	w.WriteErrorWithHeaders(response.MethodNotAllowed, "", header)
+}
+
+func parsePattern(pattern string) (*route, error) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+	if method != "" && !isMethod(method) {
+		return nil, fmt.Errorf("invalid method in pattern %q", pattern)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("pattern %q must have a path starting with /", pattern)
+	}
+
+	parts := strings.Split(path[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	names := make(map[string]bool)
+	for i, part := range parts {
+		last := i == len(parts)-1
+		var seg segment
+		switch {
+		case part == "*":
+			seg = segment{kind: segmentWildcard}
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			seg = segment{kind: segmentParam, value: name}
+			if strings.HasSuffix(name, "...") {
+				seg = segment{kind: segmentWildcard, value: strings.TrimSuffix(name, "...")}
+			}
+			if seg.value == "" || strings.ContainsAny(seg.value, "{}") {
+				return nil, fmt.Errorf("invalid parameter %q in pattern %q", part, pattern)
+			}
+			if names[seg.value] {
+				return nil, fmt.Errorf("duplicate parameter %q in pattern %q", seg.value, pattern)
+			}
+			names[seg.value] = true
+		case strings.ContainsAny(part, "{}"):
+			return nil, fmt.Errorf("invalid segment %q in pattern %q", part, pattern)
+		default:
+			seg = segment{kind: segmentLiteral, value: part}
+		}
+
+		if seg.kind == segmentWildcard && !last {
+			return nil, fmt.Errorf("wildcard must be the last segment in pattern %q", pattern)
+		}
+		segments = append(segments, seg)
+	}
+
+	return &route{
+		pattern:  pattern,
+		method:   method,
+		segments: segments,
+	}, nil
+}
+
+func (rte *route) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+
+	// Segments are split on the escaped path so an encoded "/" stays inside
+	// its segment, and compared once decoded.
+	parts := strings.Split(path[1:], "/")
+	values := make(map[string]string)
+	for i, seg := range rte.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case segmentLiteral:
+			if unescape(parts[i]) != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			values[seg.value] = unescape(parts[i])
+		case segmentWildcard:
+			if seg.value != "" {
+				values[seg.value] = unescape(strings.Join(parts[i:], "/"))
+			}
+			return values, true
+		}
+	}
+	return values, len(parts) == len(rte.segments)
+}
+
+// precedes reports whether rte should be chosen over other when both match
+// a request with the given method.
+func (rte *route) precedes(other *route, method string) bool {
+	for i := 0; i < min(len(rte.segments), len(other.segments)); i++ {
+		if rte.segments[i].kind != other.segments[i].kind {
+			return rte.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(rte.segments) != len(other.segments) {
+		return len(rte.segments) > len(other.segments)
+	}
+	return methodRank(rte.method, method) > methodRank(other.method, method)
+}
+
+// methodRank scores how well a route's method matches the request method:
+// an exact match beats GET serving HEAD, which beats a route for any method.
+// It is negative if the route doesn't accept the method at all.
+func methodRank(routeMethod, method string) int {
+	switch {
+	case routeMethod == method:
+		return 2
+	case routeMethod == "GET" && method == "HEAD":
+		return 1
+	case routeMethod == "":
+		return 0
+	default:
+		return -1
+	}
+}
+
+func sameSegments(a, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind {
+			return false
+		}
+		if a[i].kind == segmentLiteral && a[i].value != b[i].value {
+			return false
+		}
+	}
+	return true
+}
+
+// requestPath returns the escaped, normalized path of r.
+func requestPath(r *request.Request) string {
+	if r.URL != nil {
+		return r.URL.EscapedPath()
+	}
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+func unescape(s string) string {
+	unescaped, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
@@ -0,0 +1,135 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+func serve(t *testing.T, rt *Router, method, target string) string {
+	t.Helper()
+	r, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.SetRequestMethod(method)
+	rt.Serve(w, r)
+	return buf.String()
+}
+
+func named(name string) func(w *response.Writer, r *request.Request) {
+	return func(w *response.Writer, r *request.Request) {
+		body := name
+		for _, param := range []string{"id", "path", "file"} {
+			if v := r.PathValue(param); v != "" {
+				body += " " + param + "=" + v
+			}
+		}
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestRouterMatching(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users", named("list"))
+	rt.Handle("GET /users/{id}", named("show"))
+	rt.Handle("GET /users/me", named("me"))
+	rt.Handle("DELETE /users/{id}", named("delete"))
+	rt.Handle("/static/{path...}", named("static"))
+	rt.Handle("GET /static/index.html", named("index"))
+	rt.Handle("/files/*", named("files"))
+	rt.Handle("HEAD /users", named("head only"))
+
+	// Test: Literal route
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/users"), "\r\n\r\nlist"))
+
+	// Test: Named parameter
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/users/42"), "\r\n\r\nshow id=42"))
+
+	// Test: Query string is not part of the path
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/users/42?full=1"), "\r\n\r\nshow id=42"))
+
+	// Test: Literal segment beats parameter
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/users/me"), "\r\n\r\nme"))
+
+	// Test: Method specific route
+	assert.True(t, strings.HasSuffix(serve(t, rt, "DELETE", "/users/42"), "\r\n\r\ndelete id=42"))
+
+	// Test: Wildcard captures the rest of the path
+	assert.True(t, strings.HasSuffix(serve(t, rt, "POST", "/static/css/site.css"), "\r\n\r\nstatic path=css/site.css"))
+
+	// Test: Literal route beats wildcard
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/static/index.html"), "\r\n\r\nindex"))
+
+	// Test: Literal route for another method falls back to wildcard
+	assert.True(t, strings.HasSuffix(serve(t, rt, "POST", "/static/index.html"), "\r\n\r\nstatic path=index.html"))
+
+	// Test: Anonymous wildcard
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/files/a/b"), "\r\n\r\nfiles"))
+
+	// Test: GET route serves HEAD without a body
+	resp := serve(t, rt, "HEAD", "/users/42")
+	assert.Contains(t, resp, "Content-Length: 10\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+	assert.NotContains(t, resp, "show id=42")
+
+	// Test: Exact HEAD route beats GET route
+	resp = serve(t, rt, "HEAD", "/users")
+	assert.Contains(t, resp, "Content-Length: 9\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"))
+
+	// Test: Path is matched after dot segments are removed
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/static/../users/42"), "\r\n\r\nshow id=42"))
+
+	// Test: Parameters are percent-decoded, keeping encoded slashes in one segment
+	assert.True(t, strings.HasSuffix(serve(t, rt, "GET", "/users/a%2Fb%20c"), "\r\n\r\nshow id=a/b c"))
+}
+
+func TestRouterErrors(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", named("show"))
+	rt.Handle("DELETE /users/{id}", named("delete"))
+
+	// Test: Unknown path
+	resp := serve(t, rt, "GET", "/nope")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Parameter doesn't match an empty segment
+	resp = serve(t, rt, "GET", "/users/")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Known path, wrong method
+	resp = serve(t, rt, "POST", "/users/42")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, resp, "Allow: DELETE, GET, HEAD\r\n")
+}
+
+func TestRouterPatterns(t *testing.T) {
+	// Test: Invalid patterns
+	for _, pattern := range []string{
+		"users",
+		"get /users",
+		"/users/{}",
+		"/users/{id}/{id}",
+		"/files/{path...}/edit",
+		"/files/*/edit",
+		"/users/{id",
+	} {
+		assert.Panics(t, func() { New().Handle(pattern, named("x")) }, pattern)
+	}
+
+	// Test: Conflicting patterns
+	rt := New()
+	rt.Handle("GET /users/{id}", named("show"))
+	assert.Panics(t, func() { rt.Handle("GET /users/{name}", named("show")) })
+	assert.NotPanics(t, func() { rt.Handle("/users/{name}", named("show")) })
+}
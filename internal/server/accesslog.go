@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+type AccessLogFormat int
+
+const (
+	// CommonLogFormat is Apache's Common Log Format:
+	//   host ident authuser [time] "request line" status bytes
+	CommonLogFormat AccessLogFormat = iota
+	// CombinedLogFormat is the Common Log Format followed by the quoted
+	// Referer and User-Agent headers.
+	CombinedLogFormat
+	// JSONLogFormat writes each entry as a JSON object with log/slog,
+	// including the request's latency.
+	JSONLogFormat
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogEntry describes one request the server handled.
+type AccessLogEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Target     string
+	Proto      string
+	Status     response.StatusCode
+	Bytes      int
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+}
+
+// AccessLog writes a line to Output for every request the server handles,
+// including ones it answers itself because they couldn't be read or the
+// server was overloaded.
+type AccessLog struct {
+	Format AccessLogFormat
+	// Output receives the log lines, such as a RotatingFile. Nil writes to
+	// standard output.
+	Output io.Writer
+
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// Log writes e in the log's format.
+func (l *AccessLog) Log(e AccessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := l.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	switch l.Format {
+	case JSONLogFormat:
+		l.logJSON(out, e)
+	case CombinedLogFormat:
+		fmt.Fprintf(out, "%s %s %s\n", commonLogLine(e), quoteOrDash(e.Referer), quoteOrDash(e.UserAgent))
+	default:
+		fmt.Fprintln(out, commonLogLine(e))
+	}
+}
+
+func commonLogLine(e AccessLogEntry) string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	if host == "" {
+		host = "-"
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.Itoa(e.Bytes)
+	}
+	requestLine := fmt.Sprintf("%s %s %s", e.Method, e.Target, e.Proto)
+	return fmt.Sprintf("%s - - [%s] %s %d %s", host, e.Time.Format(clfTimeFormat), strconv.Quote(requestLine), int(e.Status), bytes)
+}
+
+// quoteOrDash quotes s, or returns "-" quoted if it is empty, as Apache logs
+// missing headers.
+func quoteOrDash(s string) string {
+	if s == "" {
+		s = "-"
+	}
+	return strconv.Quote(s)
+}
+
+func (l *AccessLog) logJSON(out io.Writer, e AccessLogEntry) {
+	if l.logger == nil {
+		l.logger = slog.New(slog.NewJSONHandler(out, nil))
+	}
+	l.logger.LogAttrs(context.Background(), slog.LevelInfo, "request",
+		slog.Time("start", e.Time),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("proto", e.Proto),
+		slog.Int("status", int(e.Status)),
+		slog.Int("bytes", e.Bytes),
+		slog.Duration("duration", e.Duration),
+		slog.String("referer", e.Referer),
+		slog.String("user_agent", e.UserAgent),
+	)
+}
+
+func newAccessLogEntry(r *request.Request, w *response.Writer, start time.Time) AccessLogEntry {
+	referer, _ := r.Headers.Get("Referer")
+	userAgent, _ := r.Headers.Get("User-Agent")
+	return AccessLogEntry{
+		Time:       start,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.RequestLine.Method,
+		Target:     r.RequestLine.RequestTarget,
+		Proto:      "HTTP/" + r.RequestLine.HttpVersion,
+		Status:     w.Status(),
+		Bytes:      w.BytesWritten(),
+		Duration:   time.Since(start),
+		Referer:    referer,
+		UserAgent:  userAgent,
+	}
+}
+
+// logUnreadRequest logs a response the server wrote without reading the
+// request, such as one rejected as malformed. Its request line is unknown,
+// so it is logged as dashes.
+func (s *Server) logUnreadRequest(remoteAddr string, w *response.Writer, start time.Time) {
+	if s.AccessLog == nil {
+		return
+	}
+	s.AccessLog.Log(AccessLogEntry{
+		Time:       start,
+		RemoteAddr: remoteAddr,
+		Method:     "-",
+		Target:     "-",
+		Proto:      "-",
+		Status:     w.Status(),
+		Bytes:      w.BytesWritten(),
+		Duration:   time.Since(start),
+	})
+}
+
+// RotatingFile is an io.Writer that appends to a file and rotates it once
+// it would grow too large: the file is renamed with a ".1" suffix, older
+// files shift up by one, and only a limited number of them are kept.
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, rotating it before it grows
+// past maxBytes and keeping at most maxBackups old files.
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+	rf.file = nil
+
+	if rf.maxBackups <= 0 {
+		err = os.Remove(rf.path)
+	} else {
+		os.Remove(rf.backupName(rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(rf.backupName(i), rf.backupName(i+1))
+		}
+		err = os.Rename(rf.path, rf.backupName(1))
+	}
+	// Keep logging to the same file if it couldn't be moved aside.
+	openErr := rf.open()
+	if err != nil {
+		return err
+	}
+	return openErr
+}
+
+func (rf *RotatingFile) backupName(n int) string {
+	return rf.path + "." + strconv.Itoa(n)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+// lockedBuffer is a bytes.Buffer safe to read while the server writes to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+		RemoteAddr: "127.0.0.1:5000",
+		Method:     "GET",
+		Target:     "/apache_pb.gif",
+		Proto:      "HTTP/1.1",
+		Status:     response.OK,
+		Bytes:      2326,
+		Duration:   1500 * time.Microsecond,
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  `Mozilla/4.08 "quoted"`,
+	}
+
+	// Test: Common Log Format
+	var buf bytes.Buffer
+	(&AccessLog{Format: CommonLogFormat, Output: &buf}).Log(entry)
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326`+"\n", buf.String())
+
+	// Test: Combined Log Format
+	buf.Reset()
+	(&AccessLog{Format: CombinedLogFormat, Output: &buf}).Log(entry)
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`+"\n", buf.String())
+
+	// Test: Empty values are logged as dashes
+	buf.Reset()
+	(&AccessLog{Format: CombinedLogFormat, Output: &buf}).Log(AccessLogEntry{Time: entry.Time, Method: "GET", Target: "/", Proto: "HTTP/1.1", Status: response.NoContent})
+	assert.Equal(t, `- - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 204 - "-" "-"`+"\n", buf.String())
+
+	// Test: JSON format
+	buf.Reset()
+	(&AccessLog{Format: JSONLogFormat, Output: &buf}).Log(entry)
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "request", fields["msg"])
+	assert.Equal(t, "127.0.0.1:5000", fields["remote_addr"])
+	assert.Equal(t, "/apache_pb.gif", fields["target"])
+	assert.Equal(t, float64(200), fields["status"])
+	assert.Equal(t, float64(2326), fields["bytes"])
+	assert.Equal(t, float64(1500*time.Microsecond), fields["duration"])
+	assert.Equal(t, `Mozilla/4.08 "quoted"`, fields["user_agent"])
+}
+
+func TestServerAccessLog(t *testing.T) {
+	var out lockedBuffer
+	s := &Server{
+		Handler:   textHandler("hello"),
+		AccessLog: &AccessLog{Format: CombinedLogFormat, Output: &out},
+	}
+	addr := startServer(t, s)
+
+	// Test: Each request is logged once it is handled
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET /greet?name=x HTTP/1.1\r\nUser-Agent: test-client\r\nConnection: close\r\n\r\n")
+	_, err = io.ReadAll(c)
+	require.NoError(t, err)
+	line := regexp.MustCompile(`^(127\.0\.0\.1|::1) - - \[[^\]]+\] "GET /greet\?name=x HTTP/1\.1" 200 5 "-" "test-client"\n$`)
+	assert.Eventually(t, func() bool { return line.MatchString(out.String()) }, time.Second, 10*time.Millisecond, out.String())
+
+	// Test: Requests the server rejects are logged with an unknown request line
+	out.Reset()
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET /\r\n\r\n")
+	_, err = io.ReadAll(c)
+	require.NoError(t, err)
+	line = regexp.MustCompile(`^(127\.0\.0\.1|::1) - - \[[^\]]+\] "- - -" 400 \d+ "-" "-"\n$`)
+	assert.Eventually(t, func() bool { return line.MatchString(out.String()) }, time.Second, 10*time.Millisecond, out.String())
+
+	// Test: Shed connections are logged
+	out.Reset()
+	s = &Server{
+		Handler:        textHandler("hello"),
+		AccessLog:      &AccessLog{Format: CombinedLogFormat, Output: &out},
+		MaxConns:       1,
+		OverloadPolicy: OverloadShed,
+	}
+	addr = startServer(t, s)
+	held, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer held.Close()
+	fmt.Fprint(held, "GET / HTTP/1.1\r\n\r\n")
+	_, err = readStatusLine(t, held, 2*time.Second)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return strings.Contains(out.String(), " 200 ") }, time.Second, 10*time.Millisecond)
+	out.Reset()
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.ReadAll(c)
+	require.NoError(t, err)
+	line = regexp.MustCompile(`^(127\.0\.0\.1|::1) - - \[[^\]]+\] "- - -" 503 \d+ "-" "-"\n$`)
+	assert.Eventually(t, func() bool { return line.MatchString(out.String()) }, time.Second, 10*time.Millisecond, out.String())
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer rf.Close()
+
+	// Test: Writes that fit stay in the file
+	fmt.Fprint(rf, "aaaa\n")
+	fmt.Fprint(rf, "bbbb\n")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa\nbbbb\n", string(data))
+
+	// Test: A write past the limit rotates the file first
+	fmt.Fprint(rf, "cccc\n")
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "cccc\n", string(data))
+	data, err = os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa\nbbbb\n", string(data))
+
+	// Test: Only maxBackups old files are kept
+	fmt.Fprint(rf, "dddddddddd\n")
+	fmt.Fprint(rf, "eeee\n")
+	fmt.Fprint(rf, "ffffffffff\n")
+	data, err = os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "eeee\n", string(data))
+	data, err = os.ReadFile(path + ".2")
+	require.NoError(t, err)
+	assert.Equal(t, "dddddddddd\n", string(data))
+	_, err = os.Stat(path + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Reopening appends to the existing file
+	require.NoError(t, rf.Close())
+	rf, err = OpenRotatingFile(path, 100, 2)
+	require.NoError(t, err)
+	fmt.Fprint(rf, "gggg\n")
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "ffffffffff\ngggg\n", string(data))
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+)
+
+type connState int
+
+const (
+	// stateIdle connections are waiting for the first byte of a request and
+	// can be closed at any time without losing work.
+	stateIdle connState = iota
+	// stateActive connections are reading a request or writing a response.
+	stateActive
+)
+
+// conn is an accepted connection tracked by its server so Shutdown can tell
+// idle connections from ones with requests in flight, and so request
+// deadlines can start from the first byte of each request.
+type conn struct {
+	net.Conn
+	srv *Server
+
+	// readDeadline is the deadline last set with SetReadDeadline, restored
+	// after a background read is interrupted.
+	readDeadline time.Time
+	// bg is the background read watching for a disconnect, if one is running.
+	bg *backgroundRead
+	// tlsState is set once the TLS handshake, if any, has completed.
+	tlsState *tls.ConnectionState
+
+	mu            sync.Mutex
+	state         connState
+	requestStart  time.Time
+	readTimedOut  bool
+	writeTimedOut bool
+	// begunAt is when the first byte of the request being read arrived, or
+	// zero if none has. It is tracked apart from state, which stays active
+	// when the request arrived along with the one before it.
+	begunAt time.Time
+	// pending counts pipelined responses not yet written. The connection
+	// isn't idle until they are.
+	pending       int
+	cancelRequest context.CancelFunc
+}
+
+// backgroundRead waits for a byte on an otherwise unused connection while a
+// handler runs, so the request's context can be cancelled if the client goes
+// away. A byte it reads is handed to the next Read.
+type backgroundRead struct {
+	done chan struct{}
+	buf  [1]byte
+	n    int
+	err  error
+}
+
+// aLongTimeAgo is a read deadline that interrupts a blocked read at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.stopBackgroundRead(p)
+	if n == 0 && err == nil {
+		n, err = c.Conn.Read(p)
+	}
+	if n > 0 && c.activate() {
+		c.srv.startRequestDeadline(c)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.mu.Lock()
+		c.readTimedOut = true
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.mu.Lock()
+		c.writeTimedOut = true
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// watchDisconnect cancels the context of r when the client disconnects
+// before the handler returns. The connection can only be watched once the
+// body has been read; until then the handler notices a disconnect through its
+// own reads.
+func (c *conn) watchDisconnect(r *request.Request, cancel context.CancelFunc) {
+	c.mu.Lock()
+	c.cancelRequest = cancel
+	c.mu.Unlock()
+
+	if r.BodyComplete() {
+		c.startBackgroundRead()
+		return
+	}
+	r.Body = &eofNotifier{ReadCloser: r.Body, onEOF: c.startBackgroundRead}
+}
+
+// endRequest stops cancelling the current request's context on disconnect.
+func (c *conn) endRequest() {
+	c.mu.Lock()
+	c.cancelRequest = nil
+	c.mu.Unlock()
+}
+
+func (c *conn) startBackgroundRead() {
+	if c.bg != nil {
+		return
+	}
+	bg := &backgroundRead{done: make(chan struct{})}
+	c.bg = bg
+	// The request has been read in full, so its read deadline no longer
+	// applies.
+	c.Conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(bg.done)
+		bg.n, bg.err = c.Conn.Read(bg.buf[:])
+		if bg.n == 0 && !errors.Is(bg.err, os.ErrDeadlineExceeded) {
+			c.mu.Lock()
+			cancel := c.cancelRequest
+			c.mu.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}()
+}
+
+// stopBackgroundRead interrupts a running background read and returns what
+// it read into p, restoring the read deadline for the caller's own read. It
+// returns 0 and a nil error if there is nothing to hand over.
+func (c *conn) stopBackgroundRead(p []byte) (int, error) {
+	bg := c.bg
+	if bg == nil {
+		return 0, nil
+	}
+	c.bg = nil
+	c.Conn.SetReadDeadline(aLongTimeAgo)
+	<-bg.done
+	c.Conn.SetReadDeadline(c.readDeadline)
+
+	if bg.n > 0 {
+		p[0] = bg.buf[0]
+		return 1, nil
+	}
+	if errors.Is(bg.err, os.ErrDeadlineExceeded) {
+		return 0, nil
+	}
+	return 0, bg.err
+}
+
+// eofNotifier calls onEOF once the body it wraps has been read to the end.
+type eofNotifier struct {
+	io.ReadCloser
+	onEOF func()
+	once  sync.Once
+}
+
+func (b *eofNotifier) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.onEOF)
+	}
+	return n, err
+}
+
+// activate marks the connection active, reporting whether it was idle.
+func (c *conn) activate() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.begunAt.IsZero() {
+		c.begunAt = time.Now()
+	}
+	if c.state != stateIdle {
+		return false
+	}
+	c.startRequest()
+	return true
+}
+
+// startRequest marks the connection active with a new request. c.mu must be
+// held.
+func (c *conn) startRequest() {
+	c.state = stateActive
+	c.requestStart = time.Now()
+	c.readTimedOut = false
+	c.writeTimedOut = false
+}
+
+func (c *conn) setState(state connState) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+}
+
+// addPending adds delta to the count of pipelined responses not yet written.
+func (c *conn) addPending(delta int) {
+	c.mu.Lock()
+	c.pending += delta
+	c.mu.Unlock()
+}
+
+// awaitRequest is called before reading the next request. begun reports
+// whether some of it has already been read along with an earlier one, in
+// which case the request starts now rather than on its first Read.
+func (c *conn) awaitRequest(begun bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.begunAt = time.Time{}
+	if begun {
+		c.begunAt = time.Now()
+		c.startRequest()
+	}
+}
+
+// requestBegun reports when the first byte of the request being read
+// arrived, if one has, so a timeout reading it deserves a 408 rather than a
+// silent close.
+func (c *conn) requestBegun() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.begunAt, !c.begunAt.IsZero()
+}
+
+// timedOut reports whether a read or write on the connection has hit its
+// deadline since the current request started.
+func (c *conn) timedOut() (read bool, write bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readTimedOut, c.writeTimedOut
+}
+
+func (c *conn) startedAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requestStart
+}
+
+// closeIfIdle closes the connection if it is idle, reporting whether it did.
+func (c *conn) closeIfIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != stateIdle || c.pending > 0 {
+		return false
+	}
+	c.Conn.Close()
+	return true
+}
+
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+// closeIdleConns closes every idle connection and reports whether no
+// connections remain open.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := true
+	for c := range s.conns {
+		if !c.closeIfIdle() {
+			quiescent = false
+		}
+	}
+	return quiescent
+}
+
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Conn.Close()
+	}
+}
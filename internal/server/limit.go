@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sevaergdm/httpfromtcp/internal/headers"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+// OverloadPolicy is what a server does when MaxConns or MaxInFlight is
+// reached.
+type OverloadPolicy int
+
+const (
+	// OverloadBlock waits for capacity: new connections aren't accepted and
+	// new requests aren't handled until others finish.
+	OverloadBlock OverloadPolicy = iota
+	// OverloadShed answers excess connections and requests at once with
+	// 503 Service Unavailable and a Retry-After header.
+	OverloadShed
+)
+
+const DefaultRetryAfter = time.Second
+
+// maxShedWriters bounds how many shed connections are answered with a 503 at
+// once. Each can take seconds to write and linger, so past this many a shed
+// connection is just closed.
+const maxShedWriters = 16
+
+// Stats reports a server's current load and how often it has shed load.
+type Stats struct {
+	ActiveConns  int
+	InFlight     int
+	ConnsShed    uint64
+	RequestsShed uint64
+}
+
+type limits struct {
+	once      sync.Once
+	connSlots chan struct{}
+	reqSlots  chan struct{}
+	shedSlots chan struct{}
+
+	inFlight     atomic.Int64
+	connsShed    atomic.Uint64
+	requestsShed atomic.Uint64
+}
+
+func (s *Server) initLimits() {
+	s.limits.once.Do(func() {
+		if s.MaxConns > 0 {
+			s.limits.connSlots = make(chan struct{}, s.MaxConns)
+			s.limits.shedSlots = make(chan struct{}, maxShedWriters)
+		}
+		if s.MaxInFlight > 0 {
+			s.limits.reqSlots = make(chan struct{}, s.MaxInFlight)
+		}
+	})
+}
+
+// Stats returns the server's load counters.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	activeConns := len(s.conns)
+	s.mu.Unlock()
+	return Stats{
+		ActiveConns:  activeConns,
+		InFlight:     int(s.limits.inFlight.Load()),
+		ConnsShed:    s.limits.connsShed.Load(),
+		RequestsShed: s.limits.requestsShed.Load(),
+	}
+}
+
+// waitForConnSlot blocks until another connection may be accepted under
+// OverloadBlock, reporting false if the server is closed first.
+func (s *Server) waitForConnSlot() bool {
+	s.initLimits()
+	if s.limits.connSlots == nil || s.OverloadPolicy != OverloadBlock {
+		return true
+	}
+	select {
+	case s.limits.connSlots <- struct{}{}:
+		return true
+	case <-s.baseContext().Done():
+		return false
+	}
+}
+
+// admitConn decides whether an accepted connection is served under
+// OverloadShed, answering it with a 503 if not, or closing it if too many 503s
+// are already being written.
+func (s *Server) admitConn(rwc net.Conn) bool {
+	if s.limits.connSlots == nil || s.OverloadPolicy != OverloadShed {
+		return true
+	}
+	select {
+	case s.limits.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	s.limits.connsShed.Add(1)
+	start := time.Now()
+	select {
+	case s.limits.shedSlots <- struct{}{}:
+	default:
+		rwc.Close()
+		return false
+	}
+	go func() {
+		defer func() {
+			rwc.Close()
+			<-s.limits.shedSlots
+		}()
+		rwc.SetDeadline(time.Now().Add(errorResponseTimeout))
+		w := s.newWriter(rwc)
+		w.SetKeepAlive(false)
+		ok := s.writeOverloaded(w)
+		s.logUnreadRequest(rwc.RemoteAddr().String(), w, start)
+		if ok {
+			lingeringClose(rwc)
+		}
+	}()
+	return false
+}
+
+// releaseWaitedConnSlot gives back the slot taken by waitForConnSlot when
+// no connection was accepted with it.
+func (s *Server) releaseWaitedConnSlot() {
+	if s.OverloadPolicy == OverloadBlock {
+		s.releaseConnSlot()
+	}
+}
+
+func (s *Server) releaseConnSlot() {
+	if s.limits.connSlots != nil {
+		<-s.limits.connSlots
+	}
+}
+
+// acquireRequest takes a slot for handling a request, waiting for one under
+// OverloadBlock until ctx is done. It returns false if no slot was taken.
+func (s *Server) acquireRequest(ctx context.Context) bool {
+	s.initLimits()
+	if s.limits.reqSlots != nil {
+		if s.OverloadPolicy == OverloadShed {
+			select {
+			case s.limits.reqSlots <- struct{}{}:
+			default:
+				s.limits.requestsShed.Add(1)
+				return false
+			}
+		} else {
+			select {
+			case s.limits.reqSlots <- struct{}{}:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	s.limits.inFlight.Add(1)
+	return true
+}
+
+func (s *Server) releaseRequest() {
+	s.limits.inFlight.Add(-1)
+	if s.limits.reqSlots != nil {
+		<-s.limits.reqSlots
+	}
+}
+
+// writeOverloaded answers with a 503 asking the client to retry later,
+// reporting whether the response was written.
+func (s *Server) writeOverloaded(w *response.Writer) bool {
+	retryAfter := s.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	h := headers.NewHeaders()
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	err := w.WriteErrorWithHeaders(response.ServiceUnavailable, "server overloaded", h)
+	if err != nil {
+		log.Printf("unable to write overload response: %v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+// gatedHandler blocks requests for /slow until release is closed, after
+// signalling on started.
+func gatedHandler(started chan<- struct{}, release <-chan struct{}) Handler {
+	return func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.RequestTarget == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		textHandler("ok")(w, r)
+	}
+}
+
+func readStatusLine(t *testing.T, c net.Conn, wait time.Duration) (string, error) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(wait))
+	return bufio.NewReader(c).ReadString('\n')
+}
+
+func TestMaxInFlight(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := &Server{
+		Handler:        gatedHandler(started, release),
+		MaxInFlight:    1,
+		OverloadPolicy: OverloadShed,
+		RetryAfter:     1500 * time.Millisecond,
+	}
+	addr := startServer(t, s)
+
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	fmt.Fprint(busy, "GET /slow HTTP/1.1\r\nConnection: close\r\n\r\n")
+	<-started
+
+	// Test: Requests over the limit are shed with a 503
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 503 Service Unavailable\r\n")
+	assert.Contains(t, string(resp), "Retry-After: 2\r\n")
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats.RequestsShed)
+	assert.Equal(t, 1, stats.InFlight)
+
+	// Test: The request holding the slot still completes
+	close(release)
+	resp, err = io.ReadAll(busy)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.Eventually(t, func() bool { return s.Stats().InFlight == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestMaxInFlightBlock(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := &Server{Handler: gatedHandler(started, release), MaxInFlight: 1}
+	addr := startServer(t, s)
+
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	fmt.Fprint(busy, "GET /slow HTTP/1.1\r\n\r\n")
+	<-started
+
+	// Test: Requests over the limit wait for a slot
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	_, err = readStatusLine(t, c, 100*time.Millisecond)
+	assert.Error(t, err)
+	close(release)
+	line, err := readStatusLine(t, c, 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	assert.Equal(t, uint64(0), s.Stats().RequestsShed)
+}
+
+func TestMaxConns(t *testing.T) {
+	s := &Server{Handler: textHandler("ok"), MaxConns: 1, OverloadPolicy: OverloadShed}
+	addr := startServer(t, s)
+
+	first, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer first.Close()
+	fmt.Fprint(first, "GET / HTTP/1.1\r\n\r\n")
+	line, err := readStatusLine(t, first, 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	assert.Equal(t, 1, s.Stats().ActiveConns)
+
+	// Test: Connections over the limit are shed with a 503
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 503 Service Unavailable\r\n")
+	assert.Contains(t, string(resp), "Retry-After: 1\r\n")
+	assert.Equal(t, uint64(1), s.Stats().ConnsShed)
+
+	// Test: Connections are closed without a 503 while too many 503s are being written
+	for range maxShedWriters {
+		s.limits.shedSlots <- struct{}{}
+	}
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Empty(t, resp)
+	assert.Equal(t, uint64(2), s.Stats().ConnsShed)
+	for range maxShedWriters {
+		<-s.limits.shedSlots
+	}
+
+	// Test: Closing a connection frees its slot
+	first.Close()
+	assert.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		defer c.Close()
+		fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+		line, err := readStatusLine(t, c, time.Second)
+		return err == nil && line == "HTTP/1.1 200 OK\r\n"
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestMaxConnsBlock(t *testing.T) {
+	s := &Server{Handler: textHandler("ok"), MaxConns: 1}
+	addr := startServer(t, s)
+
+	first, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer first.Close()
+	fmt.Fprint(first, "GET / HTTP/1.1\r\n\r\n")
+	_, err = readStatusLine(t, first, 2*time.Second)
+	require.NoError(t, err)
+
+	// Test: Connections over the limit wait to be accepted
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	_, err = readStatusLine(t, c, 100*time.Millisecond)
+	assert.Error(t, err)
+	first.Close()
+	line, err := readStatusLine(t, c, 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	assert.Equal(t, uint64(0), s.Stats().ConnsShed)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// unixPrefix marks an address passed to StartAddrs as a Unix socket path.
+const unixPrefix = "unix:"
+
+// DefaultSocketMode is the permission StartAddrs gives Unix sockets.
+const DefaultSocketMode fs.FileMode = 0o660
+
+// StartListener begins accepting connections from l in the background. The
+// server closes l when it is closed or shut down. It can be called more than
+// once to serve several listeners from one server.
+func (s *Server) StartListener(l net.Listener) {
+	s.mu.Lock()
+	if s.Listener == nil {
+		s.Listener = l
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	go s.listen(l)
+}
+
+// StartUnix serves on a Unix domain socket at path, created with the given
+// permissions. A socket file left behind by a server that is no longer
+// running is replaced; one still in use is an error. The file is removed
+// when the server is closed.
+func (s *Server) StartUnix(path string, mode fs.FileMode) error {
+	listener, err := listenUnix(path, mode)
+	if err != nil {
+		return err
+	}
+	s.StartListener(listener)
+	return nil
+}
+
+// StartAddrs serves on every address in addrs. Addresses are TCP host:port
+// pairs, such as ":8080" or "127.0.0.1:9090", or Unix socket paths prefixed
+// with "unix:", which are created with DefaultSocketMode. If any address
+// can't be bound, none of them are served.
+func (s *Server) StartAddrs(addrs ...string) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := listenAddr(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	for _, l := range listeners {
+		s.StartListener(l)
+	}
+	return nil
+}
+
+func listenAddr(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return listenUnix(path, DefaultSocketMode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at path if nothing is accepting
+// connections on it. It refuses to remove anything that isn't a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fetch(t *testing.T, network, addr string) string {
+	t.Helper()
+	c, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	return string(resp)
+}
+
+func TestListeners(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{Handler: textHandler("hello")}
+	t.Cleanup(func() { s.Close() })
+
+	// Test: Serves a caller-supplied listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s.StartListener(l)
+	assert.Equal(t, l, s.Listener)
+	assert.Contains(t, fetch(t, "tcp", l.Addr().String()), "\r\n\r\nhello")
+
+	// Test: Serves a Unix socket with the requested permissions
+	sock := filepath.Join(dir, "http.sock")
+	require.NoError(t, s.StartUnix(sock, 0o600))
+	info, err := os.Stat(sock)
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0o600), info.Mode().Perm())
+	assert.Contains(t, fetch(t, "unix", sock), "\r\n\r\nhello")
+
+	// Test: A socket still in use is not replaced
+	assert.ErrorContains(t, s.StartUnix(sock, 0o600), "in use")
+
+	// Test: A stale socket file is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	staleListener, err := net.Listen("unix", stale)
+	require.NoError(t, err)
+	staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+	staleListener.Close()
+	require.NoError(t, s.StartUnix(stale, 0o600))
+	assert.Contains(t, fetch(t, "unix", stale), "\r\n\r\nhello")
+
+	// Test: Files that aren't sockets are left alone
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	assert.ErrorContains(t, s.StartUnix(file, 0o600), "not a socket")
+
+	// Test: Closing the server closes every listener and removes sockets
+	require.NoError(t, s.Close())
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err)
+	_, err = os.Stat(sock)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestStartAddrs(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "admin.sock")
+	s := &Server{Handler: textHandler("hello")}
+	t.Cleanup(func() { s.Close() })
+
+	// Test: Serves TCP and Unix addresses from one server
+	require.NoError(t, s.StartAddrs("127.0.0.1:0", "unix:"+sock))
+	assert.Contains(t, fetch(t, "tcp", s.Listener.Addr().String()), "\r\n\r\nhello")
+	assert.Contains(t, fetch(t, "unix", sock), "\r\n\r\nhello")
+
+	// Test: Nothing is served if any address fails
+	other := &Server{Handler: textHandler("other")}
+	t.Cleanup(func() { other.Close() })
+	otherSock := filepath.Join(dir, "other.sock")
+	assert.Error(t, other.StartAddrs("unix:"+otherSock, "unix:"+sock))
+	assert.Nil(t, other.Listener)
+	_, err := os.Stat(otherSock)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,18 @@
+package server
+
+// Middleware wraps a Handler to add behaviour around it, such as logging,
+// authentication or timing. To see what the wrapped handler produced, use the
+// response.Writer's Status, Header and BytesWritten after it returns, or
+// OnWriteHeaders to act before the headers are sent.
+type Middleware func(Handler) Handler
+
+// Chain composes middleware into one. The first middleware is the outermost,
+// so it sees the request first and the finished response last.
+func Chain(middleware ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			h = middleware[i](h)
+		}
+		return h
+	}
+}
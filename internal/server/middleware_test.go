@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/headers"
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, r *request.Request) {
+				calls = append(calls, name+" before")
+				next(w, r)
+				calls = append(calls, name+" after")
+			}
+		}
+	}
+
+	var status response.StatusCode
+	var written int
+	var contentType string
+	observe := func(next Handler) Handler {
+		return func(w *response.Writer, r *request.Request) {
+			w.OnWriteHeaders(func(statusCode response.StatusCode, h *headers.Headers) {
+				h.Set("X-Observed", statusCode.String())
+			})
+			next(w, r)
+			status = w.Status()
+			written = w.BytesWritten()
+			contentType, _ = w.Header().Get("Content-Type")
+		}
+	}
+
+	handler := Chain(trace("outer"), trace("inner"), observe)(func(w *response.Writer, r *request.Request) {
+		calls = append(calls, "handler")
+		w.WriteError(response.NotFound, "gone fishing")
+	})
+
+	r, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	handler(response.NewWriter(&buf), r)
+
+	// Test: Middleware runs outermost first
+	assert.Equal(t, []string{"outer before", "inner before", "handler", "inner after", "outer after"}, calls)
+
+	// Test: Middleware observes what the handler wrote
+	assert.Equal(t, response.NotFound, status)
+	assert.Equal(t, len("404 Not Found\ngone fishing\n"), written)
+	assert.Equal(t, "text/plain", contentType)
+
+	// Test: Header hook can add to the response
+	assert.Contains(t, buf.String(), "X-Observed: 404 Not Found\r\n")
+}
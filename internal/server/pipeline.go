@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"time"
+
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+// pipelineSlot holds the buffered response to one pipelined request until
+// every response before it has been written.
+type pipelineSlot struct {
+	buf       bytes.Buffer
+	w         *response.Writer
+	keepAlive bool
+	linger    bool
+	done      chan struct{}
+}
+
+// handlePipelined serves a connection with up to PipelineDepth requests in
+// flight. A disconnect is noticed when writing a response fails, which
+// cancels ctx and with it every outstanding request's context.
+func (s *Server) handlePipelined(ctx context.Context, c *conn, reader *request.Reader) {
+	slots := make(chan *pipelineSlot, s.PipelineDepth-1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go s.readPipelined(ctx, c, reader, slots, stop)
+
+	for slot := range slots {
+		<-slot.done
+		c.SetWriteDeadline(deadline(time.Now(), s.WriteTimeout))
+		_, err := c.Write(slot.buf.Bytes())
+		if err != nil {
+			log.Printf("unable to write pipelined response: %v", err)
+			return
+		}
+		if slot.linger {
+			lingeringClose(c.Conn)
+		}
+		c.addPending(-1)
+		if !slot.keepAlive {
+			return
+		}
+	}
+}
+
+func (s *Server) readPipelined(ctx context.Context, c *conn, reader *request.Reader, slots chan<- *pipelineSlot, stop <-chan struct{}) {
+	defer close(slots)
+	for served := 1; ; served++ {
+		slot := &pipelineSlot{done: make(chan struct{})}
+		slot.w = s.newWriter(&slot.buf)
+
+		// Only the reader can tell that none of the next request has arrived,
+		// which is when the connection may be closed as idle.
+		if served > 1 && reader.Buffered() == 0 {
+			c.setState(stateIdle)
+			if s.Closed.Load() {
+				return
+			}
+		}
+
+		r, err := s.readRequest(c, reader, served == 1)
+		if err == nil {
+			// The next request can't be read until this body has been, so it
+			// is buffered here rather than streamed to the handler.
+			_, err = r.BodyBytes()
+		}
+		if err != nil {
+			slot.linger = s.writeReadError(c, slot.w, err)
+			close(slot.done)
+			c.addPending(1)
+			select {
+			case slots <- slot:
+			case <-stop:
+			}
+			return
+		}
+
+		keepAlive := s.keepAlive(r, served)
+		slot.w.SetHTTPVersion(r.RequestLine.HttpVersion)
+		slot.w.SetRequestMethod(r.RequestLine.Method)
+		slot.w.SetKeepAlive(keepAlive)
+
+		c.addPending(1)
+		select {
+		case slots <- slot:
+		case <-stop:
+			return
+		}
+
+		go func() {
+			defer close(slot.done)
+			reqCtx, cancel := s.requestContext(ctx)
+			defer cancel()
+			slot.keepAlive = s.serveRequest(nil, slot.w, r.WithContext(reqCtx))
+		}()
+
+		if !keepAlive {
+			return
+		}
+	}
+}
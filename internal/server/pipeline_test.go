@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+func TestPipelining(t *testing.T) {
+	s := &Server{
+		PipelineDepth: 4,
+		IdleTimeout:   200 * time.Millisecond,
+		Handler: func(w *response.Writer, r *request.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(500 * time.Millisecond)
+			}
+			textHandler(r.URL.Path)(w, r)
+		},
+	}
+	addr := startServer(t, s)
+
+	// Test: Handler outlasting the idle timeout doesn't get an unrequested 408
+	resp := roundTrip(t, addr, "GET /slow HTTP/1.1\r\n\r\n")
+	assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+	assert.NotContains(t, resp, "408")
+}
+
+func TestPipelineOrder(t *testing.T) {
+	var mu sync.Mutex
+	var finished []string
+	var fastDone chan struct{}
+	handler := func(w *response.Writer, r *request.Request) {
+		if r.URL.Path == "/slow" {
+			// Wait for /fast, which only finishes first if the two run
+			// concurrently.
+			select {
+			case <-fastDone:
+			case <-time.After(300 * time.Millisecond):
+			}
+		}
+		textHandler(r.URL.Path)(w, r)
+		mu.Lock()
+		finished = append(finished, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/fast" {
+			close(fastDone)
+		}
+	}
+
+	serve := func(s *Server) string {
+		finished = nil
+		fastDone = make(chan struct{})
+		resp := roundTrip(t, startServer(t, s), "GET /slow HTTP/1.1\r\n\r\nGET /fast HTTP/1.1\r\nConnection: close\r\n\r\n")
+		mu.Lock()
+		defer mu.Unlock()
+		return resp
+	}
+
+	// Test: Responses are written in request order when handlers finish out of order
+	resp := serve(&Server{PipelineDepth: 2, Handler: handler})
+	assert.Equal(t, []string{"/fast", "/slow"}, finished)
+	slow, fast, ok := strings.Cut(resp, "\r\n\r\n/slow")
+	require.True(t, ok, resp)
+	assert.True(t, strings.HasPrefix(slow, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.True(t, strings.HasSuffix(fast, "\r\n\r\n/fast"), resp)
+
+	// Test: Requests are handled one at a time when the body limit is disabled
+	resp = serve(&Server{
+		PipelineDepth: 2,
+		ParserOptions: request.ParserOptions{MaxBodyBytes: -1},
+		Handler:       handler,
+	})
+	assert.Equal(t, []string{"/slow", "/fast"}, finished)
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n/fast"), resp)
+}
+
+func TestPipelineShutdown(t *testing.T) {
+	// Test: A request that arrived with the one before it isn't closed as idle
+	for _, depth := range []int{0, 2} {
+		s := &Server{PipelineDepth: depth, Handler: func(w *response.Writer, r *request.Request) {
+			textHandler(r.URL.Path)(w, r)
+		}}
+		addr := startServer(t, s)
+
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprint(c, "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n")
+		var resp []byte
+		buf := make([]byte, 512)
+		for !strings.HasSuffix(string(resp), "\r\n\r\n/a") {
+			n, err := c.Read(buf)
+			require.NoError(t, err, string(resp))
+			resp = append(resp, buf[:n]...)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		shutdownErr := make(chan error, 1)
+		go func() {
+			shutdownErr <- s.Shutdown(context.Background())
+		}()
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(c, "\r\n")
+		resp, err = io.ReadAll(c)
+		require.NoError(t, err, "depth %d", depth)
+		assert.Contains(t, string(resp), "Connection: close\r\n", "depth %d", depth)
+		assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\n/b"), "depth %d: %s", depth, resp)
+		require.NoError(t, <-shutdownErr)
+	}
+}
@@ -1,74 +1,658 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/sevaergdm/httpfromtcp/internal/headers"
 	"github.com/sevaergdm/httpfromtcp/internal/request"
 	"github.com/sevaergdm/httpfromtcp/internal/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// HandlerFunc is a handler that reports failure by returning an error
+// rather than writing the error response itself. Use HandleErrors to turn it
+// into a Handler.
+type HandlerFunc func(w *response.Writer, req *request.Request) error
+
+// HandlerError is returned by a HandlerFunc to choose the status code and
+// message of the error response.
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
 }
 
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("handler error %d: %s", e.StatusCode, e.Message)
+}
+
+// HandleErrors adapts h into a Handler. When h returns a *HandlerError its
+// StatusCode and Message become the response; any other error is answered
+// with a 500. If h already started writing its response, the error can only
+// be logged.
+func HandleErrors(h HandlerFunc) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		err := h(w, req)
+		if err != nil {
+			writeHandlerError(w, req, err)
+		}
+	}
+}
+
+func writeHandlerError(w *response.Writer, req *request.Request, err error) {
+	statusCode := response.InternalServerError
+	message := ""
+	var handlerErr *HandlerError
+	if errors.As(err, &handlerErr) {
+		statusCode = handlerErr.StatusCode
+		message = handlerErr.Message
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		statusCode = response.RequestTimeout
+	}
+
+	if w.Started() {
+		log.Printf("handler error after response started for %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+		w.Abort()
+		return
+	}
+	if handlerErr == nil {
+		log.Printf("handler error for %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+	}
+
+	err = w.WriteError(statusCode, message)
+	if err != nil {
+		log.Printf("unable to write error response: %v", err)
+	}
+}
+
+const (
+	DefaultIdleTimeout       = 60 * time.Second
+	DefaultReadHeaderTimeout = 10 * time.Second
+)
+
+// errorResponseTimeout bounds writing a response the server generates when
+// it gives up on a request.
+const errorResponseTimeout = 5 * time.Second
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+const (
+	lingerTimeout  = 500 * time.Millisecond
+	lingerMaxBytes = 256 << 10
+)
+
 type Server struct {
+	// Listener is the first listener the server was started on.
 	Listener net.Listener
 	Closed   atomic.Bool
 	Handler  Handler
+
+	// ReadHeaderTimeout is how long a client has to send a request's line and
+	// headers, counted from the request's first byte (or, for the first
+	// request, from accepting the connection). Zero falls back to ReadTimeout.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send a whole request, body
+	// included, counted from its first byte. Zero means no timeout.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long the server has to write a response, counted
+	// from the end of the request headers. Zero means no timeout.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a persistent connection may wait for its next
+	// request before it is closed. Zero falls back to ReadHeaderTimeout.
+	IdleTimeout time.Duration
+	// MaxRequestsPerConn caps the number of requests served on a single
+	// connection. Zero means no limit.
+	MaxRequestsPerConn int
+	// PipelineDepth is how many pipelined requests on one connection may be
+	// handled concurrently. Responses are still written in request order.
+	// Values below 2 handle requests one at a time.
+	//
+	// To read ahead, the server buffers each pipelined request's body before
+	// its handler runs, and buffers the whole response until it can be
+	// written, so a streaming handler sends nothing until it returns. As the
+	// bodies are held in memory, requests are handled one at a time when
+	// ParserOptions.MaxBodyBytes disables the body limit.
+	PipelineDepth int
+	// ParserOptions limits the size of requests the server accepts.
+	ParserOptions request.ParserOptions
+	// ErrorFormatter renders the body of error responses the server writes on
+	// its own, such as when a request can't be parsed. Nil uses
+	// response.DefaultErrorFormatter.
+	ErrorFormatter response.ErrorFormatter
+	// PreserveHeaderCase sends response header names in the case handlers
+	// set them in rather than canonicalizing them.
+	PreserveHeaderCase bool
+	// TLSConfig configures StartTLS. It is cloned before use.
+	TLSConfig *tls.Config
+	// Certificates, if set, supplies the certificates for StartTLS, chosen
+	// by SNI and reloaded when their files change.
+	Certificates *CertStore
+	// ClientCAs, if set, makes StartTLS verify client certificates against
+	// these authorities, as ClientAuth requires.
+	ClientCAs  *x509.CertPool
+	ClientAuth ClientAuthMode
+	// MaxConns caps the number of connections open at once. Zero means no
+	// limit.
+	MaxConns int
+	// MaxInFlight caps the number of requests being handled at once across
+	// all connections. Zero means no limit.
+	MaxInFlight int
+	// OverloadPolicy chooses between waiting and answering with a 503 when
+	// MaxConns or MaxInFlight is reached.
+	OverloadPolicy OverloadPolicy
+	// RetryAfter is sent with 503 responses when shedding load. Zero uses
+	// DefaultRetryAfter.
+	RetryAfter time.Duration
+	// AccessLog, if set, records every request the server handles.
+	AccessLog *AccessLog
+	// PanicHook, if set, is called with the recovered value and stack trace
+	// when a handler panics, after the panic has been logged.
+	PanicHook func(r *request.Request, recovered any, stack []byte)
+
+	mu         sync.Mutex
+	listeners  []net.Listener
+	conns      map[*conn]struct{}
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+	watchCerts sync.Once
+	limits     limits
 }
 
-func (s *Server) listen() {
+func (s *Server) listen(l net.Listener) {
 	for {
-		conn, err := s.Listener.Accept()
+		if !s.waitForConnSlot() {
+			return
+		}
+		rwc, err := l.Accept()
 		if err != nil {
-			if s.Closed.Load() {
+			s.releaseWaitedConnSlot()
+			if s.Closed.Load() || errors.Is(err, net.ErrClosed) {
 				return
 			}
 			log.Printf("accept error: %v", err)
 			continue
 		}
 
-		go s.handle(conn)
+		if s.Closed.Load() {
+			s.releaseWaitedConnSlot()
+			rwc.Close()
+			return
+		}
+		if !s.admitConn(rwc) {
+			continue
+		}
+
+		c := &conn{Conn: rwc, srv: s}
+		s.trackConn(c, true)
+		go s.handle(c)
 	}
 }
 
+// Close stops accepting connections and immediately closes every open
+// connection, including ones with requests in flight. Use Shutdown to let
+// them finish.
 func (s *Server) Close() error {
 	s.Closed.Store(true)
-	if s.Listener != nil {
-		return s.Listener.Close()
+	err := s.closeListeners()
+	s.cancelBaseContext()
+	s.closeAllConns()
+	return err
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for
+// in-flight requests to finish, closing each connection once its response is
+// written. If ctx expires first, the contexts of the remaining requests are
+// cancelled, their connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Closed.Store(true)
+	err := s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !s.closeIdleConns() {
+		select {
+		case <-ctx.Done():
+			s.cancelBaseContext()
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	s.cancelBaseContext()
+	return err
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, l := range s.listeners {
+		err := l.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	s.listeners = nil
+	return errors.Join(errs...)
+}
+
+// baseContext returns the context every request's context derives from. It
+// is cancelled when the server is closed or has shut down, or when Shutdown
+// gives up waiting.
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initBaseContext()
+	return s.baseCtx
+}
+
+func (s *Server) cancelBaseContext() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initBaseContext()
+	s.cancelBase()
+}
+
+func (s *Server) initBaseContext() {
+	if s.baseCtx == nil {
+		s.baseCtx, s.cancelBase = context.WithCancel(context.Background())
+	}
+}
+
+// requestContext derives the context of a request from its connection's,
+// bounding it by WriteTimeout when one is set.
+func (s *Server) requestContext(connCtx context.Context) (context.Context, context.CancelFunc) {
+	if s.WriteTimeout > 0 {
+		return context.WithTimeout(connCtx, s.WriteTimeout)
+	}
+	return context.WithCancel(connCtx)
+}
+
+func (s *Server) handle(c *conn) {
+	ctx, cancel := context.WithCancel(s.baseContext())
+	defer func() {
+		cancel()
+		c.Close()
+		s.trackConn(c, false)
+		s.releaseConnSlot()
+	}()
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok && !s.handshake(ctx, c, tlsConn) {
+		return
+	}
+
+	reader := request.NewReaderWithOptions(c, s.ParserOptions)
+	if s.PipelineDepth > 1 && s.ParserOptions.MaxBodyBytes >= 0 {
+		s.handlePipelined(ctx, c, reader)
+		return
+	}
+
+	for served := 1; ; served++ {
+		r, err := s.readRequest(c, reader, served == 1)
+		if err != nil {
+			c.SetWriteDeadline(time.Now().Add(errorResponseTimeout))
+			// A body left unread still has input behind it, which closing
+			// outright would answer with a reset that can lose the response
+			// already sent.
+			if s.writeReadError(c, s.newWriter(c), err) || errors.Is(err, request.ErrUnreadBody) {
+				lingeringClose(c.Conn)
+			}
+			return
+		}
+
+		if s.WriteTimeout > 0 {
+			c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		}
+		reqCtx, cancelReq := s.requestContext(ctx)
+		r = r.WithContext(reqCtx)
+		c.watchDisconnect(r, cancelReq)
+
+		w := s.newWriter(c)
+		w.SetHTTPVersion(r.RequestLine.HttpVersion)
+		w.SetRequestMethod(r.RequestLine.Method)
+		w.SetKeepAlive(s.keepAlive(r, served))
+		keepAlive := s.serveRequest(c, w, r)
+		c.endRequest()
+		cancelReq()
+		if !keepAlive {
+			return
+		}
+		if reader.Buffered() == 0 {
+			c.setState(stateIdle)
+			if s.Closed.Load() {
+				return
+			}
+		}
+	}
+}
+
+// readRequest reads the next request's line and headers. The wait for its
+// first byte is bounded by the idle timeout, or by the header timeout for a
+// connection's first request or one that arrived with the request before it.
+// Once the request is read, the read deadline covers its body.
+func (s *Server) readRequest(c *conn, reader *request.Reader, first bool) (*request.Request, error) {
+	begun := reader.Buffered() > 0
+	c.awaitRequest(begun)
+	wait := s.IdleTimeout
+	if first || begun || wait == 0 {
+		wait = s.headerTimeout()
+	}
+	c.SetReadDeadline(deadline(time.Now(), wait))
+
+	r, err := reader.ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+	err = checkTargetForm(r.RequestLine)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetReadDeadline(deadline(c.startedAt(), s.ReadTimeout))
+	r.RemoteAddr = c.RemoteAddr().String()
+	r.TLS = c.tlsState
+	return r, nil
+}
+
+// checkTargetForm rejects request targets in a form the method doesn't
+// allow: CONNECT takes only the authority-form, and the asterisk-form is only
+// for OPTIONS.
+func checkTargetForm(rl request.RequestLine) error {
+	allowed := true
+	switch {
+	case rl.Method == "CONNECT":
+		allowed = rl.TargetForm == request.AuthorityForm
+	case rl.TargetForm == request.AuthorityForm:
+		allowed = false
+	case rl.TargetForm == request.AsteriskForm:
+		allowed = rl.Method == "OPTIONS"
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s not allowed for %s", request.ErrMalformedRequest, rl.TargetForm, rl.Method)
 	}
 	return nil
 }
 
-func (s *Server) handle(c net.Conn) {
-	defer c.Close()
-	r, err := request.RequestFromReader(c)
+// startRequestDeadline is called when the first byte of a request arrives on
+// an idle connection.
+func (s *Server) startRequestDeadline(c *conn) {
+	c.SetReadDeadline(deadline(time.Now(), s.headerTimeout()))
+}
+
+func (s *Server) headerTimeout() time.Duration {
+	if s.ReadHeaderTimeout > 0 {
+		return s.ReadHeaderTimeout
+	}
+	return s.ReadTimeout
+}
+
+// deadline returns start+timeout, or the zero time (no deadline) if timeout
+// is zero.
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+// serveRequest runs the handler and completes its response, reporting
+// whether the connection can be reused for another request. c is nil when
+// the handler neither reads from nor writes to the connection directly, as
+// with pipelined requests, so connection timeouts can't affect it.
+func (s *Server) serveRequest(c *conn, w *response.Writer, r *request.Request) bool {
+	if s.AccessLog != nil {
+		start := time.Now()
+		defer func() {
+			s.AccessLog.Log(newAccessLogEntry(r, w, start))
+		}()
+	}
+	w.OnWriteHeaders(func(response.StatusCode, *headers.Headers) {
+		if s.Closed.Load() {
+			w.SetKeepAlive(false)
+		}
+	})
+
+	if !s.acquireRequest(r.Context()) {
+		if s.OverloadPolicy != OverloadShed {
+			// The request was cancelled while waiting its turn.
+			return false
+		}
+		return s.writeOverloaded(w) && w.Finish() == nil && w.KeepAlive()
+	}
+	defer s.releaseRequest()
+	s.runHandler(w, r)
+
+	if c != nil {
+		readTimedOut, _ := c.timedOut()
+		if readTimedOut && !w.Started() {
+			log.Printf("timed out reading body of %s %s from %s", r.RequestLine.Method, r.RequestLine.RequestTarget, c.RemoteAddr())
+			w.SetKeepAlive(false)
+			w.WriteError(response.RequestTimeout, "")
+		}
+	}
+
+	err := w.Finish()
+	if c != nil {
+		readTimedOut, writeTimedOut := c.timedOut()
+		if writeTimedOut {
+			log.Printf("timed out writing response to %s %s for %s", r.RequestLine.Method, r.RequestLine.RequestTarget, c.RemoteAddr())
+			return false
+		}
+		if readTimedOut {
+			return false
+		}
+	}
 	if err != nil {
-		return
+		log.Printf("unable to finish response: %v", err)
+		return false
 	}
+	return w.KeepAlive()
+}
 
-	w := response.NewWriter(c)
+// runHandler calls the handler, recovering from a panic so that it only
+// fails this request: the client gets a 500 if the response hasn't started,
+// or a response cut short if it has, and the connection is closed.
+func (s *Server) runHandler(w *response.Writer, r *request.Request) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		stack := debug.Stack()
+		log.Printf("panic serving %s %s for %s: %v\n%s", r.RequestLine.Method, r.RequestLine.RequestTarget, r.RemoteAddr, recovered, stack)
+		if s.PanicHook != nil {
+			s.PanicHook(r, recovered, stack)
+		}
+
+		if w.Started() {
+			w.Abort()
+			return
+		}
+		w.SetKeepAlive(false)
+		err := w.WriteError(response.InternalServerError, "")
+		if err != nil {
+			log.Printf("unable to write error response: %v", err)
+		}
+	}()
 	s.Handler(w, r)
 }
 
-func Serve(handler Handler, port int) (*Server, error) {
+func (s *Server) newWriter(dst io.Writer) *response.Writer {
+	w := response.NewWriter(dst)
+	w.SetErrorFormatter(s.ErrorFormatter)
+	w.SetPreserveHeaderCase(s.PreserveHeaderCase)
+	return w
+}
+
+// writeReadError answers a request that couldn't be read, either because
+// the parser rejected it or because the client was too slow sending it.
+// Errors that leave nothing to answer, such as the client disconnecting, an
+// idle connection timing out or a bad body the previous handler left unread,
+// are ignored. It reports whether a response was
+// written. The error itself is only logged: it can quote the request or the
+// connection's addresses, so the client gets just the status.
+func (s *Server) writeReadError(c *conn, w *response.Writer, err error) bool {
+	if errors.Is(err, request.ErrUnreadBody) {
+		log.Printf("closing connection from %s: %v", c.RemoteAddr(), err)
+		return false
+	}
+	start, begun := c.requestBegun()
+	if !begun {
+		start = time.Now()
+	}
+	statusCode, ok := parseErrorStatus(err)
+	if ok {
+		log.Printf("rejected request from %s: %v", c.RemoteAddr(), err)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && begun {
+		log.Printf("timed out reading request from %s: %v", c.RemoteAddr(), err)
+		statusCode, ok = response.RequestTimeout, true
+	}
+	if !ok {
+		return false
+	}
+
+	w.SetKeepAlive(false)
+	err = w.WriteError(statusCode, "")
+	s.logUnreadRequest(c.RemoteAddr().String(), w, start)
+	if err != nil {
+		log.Printf("unable to write error response: %v", err)
+		return false
+	}
+	return true
+}
+
+// lingeringClose stops writing and briefly discards whatever the client is
+// still sending, so closing a connection with unread input doesn't reset it
+// before the client has read the response.
+func lingeringClose(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	c.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.Copy(io.Discard, io.LimitReader(c, lingerMaxBytes))
+}
+
+func parseErrorStatus(err error) (response.StatusCode, bool) {
+	switch {
+	case errors.Is(err, request.ErrURITooLong):
+		return response.URITooLong, true
+	case errors.Is(err, request.ErrHeaderFieldsTooLarge):
+		return response.RequestHeaderFieldsTooLarge, true
+	case errors.Is(err, request.ErrPayloadTooLarge):
+		return response.ContentTooLarge, true
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.HTTPVersionNotSupported, true
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.NotImplemented, true
+	case errors.Is(err, request.ErrMalformedRequest):
+		return response.BadRequest, true
+	default:
+		return 0, false
+	}
+}
+
+func (s *Server) keepAlive(r *request.Request, served int) bool {
+	if s.Closed.Load() || !r.KeepAlive() {
+		return false
+	}
+	return s.MaxRequestsPerConn <= 0 || served < s.MaxRequestsPerConn
+}
+
+// Start binds the server to port and begins accepting connections in the
+// background. Configure the server's fields before calling Start.
+func (s *Server) Start(port int) error {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	s.StartListener(listener)
+	return nil
+}
+
+// StartTLS is like Start but serves HTTPS, using TLSConfig and Certificates.
+// When Certificates is set, its files are watched for changes until the
+// server is closed.
+func (s *Server) StartTLS(port int) error {
+	_, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
 	}
+	return s.StartTLSListener(listener)
+}
 
+// StartTLSListener is like StartListener but serves HTTPS on l, as StartTLS
+// does.
+func (s *Server) StartTLSListener(l net.Listener) error {
+	config, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	if s.Certificates != nil {
+		s.watchCerts.Do(func() {
+			go s.Certificates.Watch(s.baseContext(), certPollInterval)
+		})
+	}
+	s.StartListener(tls.NewListener(l, config))
+	return nil
+}
+
+func Serve(handler Handler, port int) (*Server, error) {
 	server := &Server{
-		Listener: listener,
-		Handler:  handler,
+		Handler:           handler,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
 	}
 
-	go server.listen()
+	err := server.Start(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// ServeTLS is like Serve but serves HTTPS with the certificate and key in
+// certFile and keyFile, reloading them when they change.
+func ServeTLS(handler Handler, port int, certFile, keyFile string) (*Server, error) {
+	certs, err := LoadCertStore(KeyPair{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		return nil, err
+	}
+	return serveTLS(&Server{Certificates: certs}, handler, port)
+}
+
+// ServeTLSWithConfig is like Serve but serves HTTPS with config.
+func ServeTLSWithConfig(handler Handler, port int, config *tls.Config) (*Server, error) {
+	return serveTLS(&Server{TLSConfig: config}, handler, port)
+}
+
+func serveTLS(server *Server, handler Handler, port int) (*Server, error) {
+	server.Handler = handler
+	server.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	server.IdleTimeout = DefaultIdleTimeout
+
+	err := server.StartTLS(port)
+	if err != nil {
+		return nil, err
+	}
 
 	return server, nil
 }
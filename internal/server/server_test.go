@@ -0,0 +1,674 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/headers"
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	require.NoError(t, s.Start(0))
+	t.Cleanup(func() { s.Close() })
+	return s.Listener.Addr().String()
+}
+
+// roundTrip sends raw on a new connection and returns everything the
+// server writes back until it closes the connection.
+func roundTrip(t *testing.T, addr, raw string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, raw)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	return string(resp)
+}
+
+func textHandler(body string) Handler {
+	return func(w *response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := &Server{Handler: textHandler("ok")}
+	addr := startServer(t, s)
+
+	// readResponse reads one response to the end of its "ok" body without
+	// waiting for the connection to close.
+	readResponse := func(c net.Conn) string {
+		var resp []byte
+		buf := make([]byte, 512)
+		for !strings.HasSuffix(string(resp), "\r\n\r\nok") {
+			n, err := c.Read(buf)
+			require.NoError(t, err, string(resp))
+			resp = append(resp, buf[:n]...)
+		}
+		return string(resp)
+	}
+
+	// Test: Two requests are served on one connection
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for range 2 {
+		fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+		resp := readResponse(c)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+		assert.NotContains(t, resp, "Connection: close")
+	}
+
+	// Test: Connection: close ends the connection after the response
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\nok"), string(resp))
+
+	// Test: MaxRequestsPerConn ends the connection after the last request
+	s = &Server{Handler: textHandler("ok"), MaxRequestsPerConn: 2}
+	addr = startServer(t, s)
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	assert.NotContains(t, readResponse(c), "Connection: close")
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\nok"), string(resp))
+}
+
+func TestUnreadBody(t *testing.T) {
+	s := &Server{
+		Handler:       textHandler("ok"),
+		ParserOptions: request.ParserOptions{MaxBodyBytes: 8},
+	}
+	addr := startServer(t, s)
+
+	// Test: A bad body the handler didn't read closes the connection without a second response
+	for _, body := range []string{
+		"zz\r\n",
+		"10\r\n0123456789abcdef\r\n0\r\n\r\n",
+	} {
+		resp := roundTrip(t, addr, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"+body+"GET / HTTP/1.1\r\n\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+		assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1 "), resp)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		textHandler("done")(w, r)
+	}}
+	addr := startServer(t, s)
+
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+
+	fmt.Fprint(busy, "GET /slow HTTP/1.1\r\n\r\n")
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// Test: Idle connection is closed right away
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: In-flight request finishes before Shutdown returns
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	resp, err := io.ReadAll(busy)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "Connection: close\r\n")
+	assert.Contains(t, string(resp), "\r\n\r\ndone")
+	require.NoError(t, <-shutdownErr)
+
+	// Test: No new connections are accepted
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		close(started)
+		time.Sleep(time.Second)
+	}}
+	addr := startServer(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	<-started
+
+	// Test: Remaining connections are closed when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = bufio.NewReader(c).ReadByte()
+	assert.Error(t, err)
+}
+
+func TestTimeouts(t *testing.T) {
+	s := &Server{
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		ReadTimeout:       300 * time.Millisecond,
+		IdleTimeout:       100 * time.Millisecond,
+		Handler: HandleErrors(func(w *response.Writer, r *request.Request) error {
+			body, err := r.BodyBytes()
+			if err != nil {
+				return err
+			}
+			textHandler(string(body))(w, r)
+			return nil
+		}),
+	}
+	addr := startServer(t, s)
+
+	// Test: Connection that never sends a byte is closed without a response
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(resp))
+
+	// Test: Slow headers get a 408
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: local")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 408 Request Timeout\r\n")
+
+	// Test: The timeout error isn't echoed to the client
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\n408 Request Timeout\n"), string(resp))
+
+	// Test: Slow body gets a 408
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 408 Request Timeout\r\n")
+
+	// Test: Idle keep-alive connection is closed after a response
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.NotContains(t, string(resp), "408")
+}
+
+func TestRequestContext(t *testing.T) {
+	type ctxKey struct{}
+	errs := make(chan error, 1)
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		switch r.RequestLine.RequestTarget {
+		case "/wait":
+			r.BodyBytes()
+			select {
+			case <-r.Context().Done():
+				errs <- r.Context().Err()
+			case <-time.After(2 * time.Second):
+				errs <- nil
+			}
+		case "/value":
+			textHandler(r.Context().Value(ctxKey{}).(string))(w, r)
+		default:
+			textHandler("ok")(w, r)
+		}
+	}}
+	withValue := func(next Handler) Handler {
+		return func(w *response.Writer, r *request.Request) {
+			next(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, "from middleware")))
+		}
+	}
+	s.Handler = withValue(s.Handler)
+	addr := startServer(t, s)
+
+	// Test: Client disconnect cancels the context
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	fmt.Fprint(c, "GET /wait HTTP/1.1\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// Test: Disconnect after sending a body cancels the context
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	fmt.Fprint(c, "POST /wait HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// Test: Middleware values reach the handler
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET /value HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "\r\n\r\nfrom middleware")
+
+	// Test: Watching for a disconnect doesn't lose the next request's bytes
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	br := bufio.NewReader(c)
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	time.Sleep(50 * time.Millisecond)
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err = io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+
+	// Test: Closing the server cancels the context
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET /wait HTTP/1.1\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+}
+
+func TestRequestContextWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	s := &Server{
+		WriteTimeout: 100 * time.Millisecond,
+		Handler: func(w *response.Writer, r *request.Request) {
+			<-r.Context().Done()
+			errs <- r.Context().Err()
+		},
+	}
+	addr := startServer(t, s)
+
+	// Test: WriteTimeout bounds the context
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\n\r\n")
+	select {
+	case err = <-errs:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(2 * time.Second):
+		t.Fatal("context not cancelled by WriteTimeout")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	type panicked struct {
+		target    string
+		recovered any
+		stack     string
+	}
+	hooked := make(chan panicked, 2)
+	s := &Server{
+		Handler: func(w *response.Writer, r *request.Request) {
+			switch r.RequestLine.RequestTarget {
+			case "/early":
+				panic("before writing")
+			case "/late":
+				w.WriteStatusLine(response.OK)
+				h := headers.NewHeaders()
+				h.Set("Transfer-Encoding", "chunked")
+				w.WriteHeaders(h)
+				w.WriteChunkedBody([]byte("partial"))
+				panic("after writing")
+			default:
+				textHandler("ok")(w, r)
+			}
+		},
+		PanicHook: func(r *request.Request, recovered any, stack []byte) {
+			hooked <- panicked{r.RequestLine.RequestTarget, recovered, string(stack)}
+		},
+	}
+	addr := startServer(t, s)
+
+	// Test: Panic before the response starts gets a 500 and closes the connection
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET /early HTTP/1.1\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Contains(t, string(resp), "Connection: close\r\n")
+
+	// Test: Panic hook receives the value and stack trace
+	p := <-hooked
+	assert.Equal(t, "/early", p.target)
+	assert.Equal(t, "before writing", p.recovered)
+	assert.Contains(t, p.stack, "TestPanicRecovery")
+
+	// Test: Panic after the response starts cuts it short
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET /late HTTP/1.1\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, string(resp), "7\r\npartial\r\n")
+	assert.NotContains(t, string(resp), "0\r\n\r\n")
+	assert.Equal(t, "/late", (<-hooked).target)
+
+	// Test: Server keeps serving after a panic
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "\r\n\r\nok")
+}
+
+func TestTargetForms(t *testing.T) {
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		textHandler(r.RequestLine.TargetForm.String())(w, r)
+	}}
+	addr := startServer(t, s)
+
+	const fields = "\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+	// Test: Each form is served with the methods that allow it
+	for requestLine, form := range map[string]string{
+		"GET /index.html HTTP/1.1":             "origin-form",
+		"GET http://example.com/ HTTP/1.1":     "absolute-form",
+		"CONNECT example.com:443 HTTP/1.1":     "authority-form",
+		"OPTIONS * HTTP/1.1":                   "asterisk-form",
+		"OPTIONS http://example.com/ HTTP/1.1": "absolute-form",
+	} {
+		resp := roundTrip(t, addr, requestLine+fields)
+		assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n", requestLine)
+		assert.True(t, strings.HasSuffix(resp, form), requestLine)
+	}
+
+	// Test: Forms the method doesn't allow are rejected
+	for _, requestLine := range []string{
+		"GET example.com:443 HTTP/1.1",
+		"CONNECT /index.html HTTP/1.1",
+		"CONNECT http://example.com/ HTTP/1.1",
+		"GET * HTTP/1.1",
+		"CONNECT * HTTP/1.1",
+	} {
+		assert.Contains(t, roundTrip(t, addr, requestLine+fields), "HTTP/1.1 400 Bad Request\r\n", requestLine)
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.RequestTarget != "/stream" {
+			textHandler("ok")(w, r)
+			return
+		}
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("streamed "))
+		w.WriteChunkedBody([]byte("body"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.NewHeaders())
+	}}
+	addr := startServer(t, s)
+
+	// Test: Connections close after the response by default
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET / HTTP/1.0\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, string(resp), "Connection: close\r\n")
+
+	// Test: Connection keep-alive is honored and echoed
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for range 2 {
+		fmt.Fprint(c, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.0 200 OK\r\n", line)
+		var sawKeepAlive bool
+		for {
+			line, err = reader.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\r\n" {
+				break
+			}
+			sawKeepAlive = sawKeepAlive || line == "Connection: keep-alive\r\n"
+		}
+		assert.True(t, sawKeepAlive)
+		body := make([]byte, len("ok"))
+		_, err = io.ReadFull(reader, body)
+		require.NoError(t, err)
+	}
+
+	// Test: Chunked responses are sent close-delimited
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nstreamed body", string(resp))
+}
+
+func TestHandleErrors(t *testing.T) {
+	s := &Server{Handler: HandleErrors(func(w *response.Writer, r *request.Request) error {
+		switch r.URL.Path {
+		case "/teapot":
+			return fmt.Errorf("brewing: %w", &HandlerError{StatusCode: 418, Message: "short and stout"})
+		case "/plain":
+			return errors.New("secret internal detail")
+		case "/started":
+			w.WriteStatusLine(response.OK)
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("partial"))
+			return errors.New("failed midway")
+		}
+		textHandler("ok")(w, r)
+		return nil
+	})}
+	addr := startServer(t, s)
+
+	get := func(target string) string {
+		return roundTrip(t, addr, "GET "+target+" HTTP/1.1\r\nConnection: close\r\n\r\n")
+	}
+
+	// Test: A HandlerError sets the status and message, even when wrapped
+	resp := get("/teapot")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 418 "), resp)
+	assert.Contains(t, resp, "short and stout\n")
+
+	// Test: Any other error is a 500 that doesn't reveal the error
+	resp = get("/plain")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"), resp)
+	assert.NotContains(t, resp, "secret")
+
+	// Test: An error after the response started aborts it instead of writing a second status line
+	resp = get("/started")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1 "), resp)
+	assert.Contains(t, resp, "partial")
+	assert.False(t, strings.HasSuffix(resp, "0\r\n\r\n"), resp)
+}
+
+func TestParseErrorResponses(t *testing.T) {
+	s := &Server{
+		Handler: textHandler("ok"),
+		ParserOptions: request.ParserOptions{
+			MaxRequestLineBytes: 64,
+			MaxHeaderBytes:      64,
+			MaxBodyBytes:        4,
+		},
+	}
+	addr := startServer(t, s)
+
+	// Test: Each parse error gets its status, and the connection is closed
+	for _, tc := range []struct {
+		req    string
+		status string
+	}{
+		{"GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", "414 URI Too Long"},
+		{"GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 100) + "\r\n\r\n", "431 Request Header Fields Too Large"},
+		{"POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789", "413 Content Too Large"},
+		{"GET / HTTP/2.0\r\n\r\n", "505 HTTP Version Not Supported"},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", "501 Not Implemented"},
+		{"GET /\r\n\r\n", "400 Bad Request"},
+	} {
+		resp := roundTrip(t, addr, tc.req)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 "+tc.status+"\r\n"), resp)
+		assert.Contains(t, resp, "Connection: close\r\n", tc.status)
+		assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"+tc.status+"\n"), resp)
+	}
+
+	// Test: A custom ErrorFormatter renders the body
+	s = &Server{
+		Handler: s.Handler,
+		ErrorFormatter: func(statusCode response.StatusCode, message string) (string, []byte) {
+			return "application/json", []byte(fmt.Sprintf(`{"status":%d}`, statusCode))
+		},
+	}
+	addr = startServer(t, s)
+	resp := roundTrip(t, addr, "GET / HTTP/2.0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 505 HTTP Version Not Supported\r\n"), resp)
+	assert.Contains(t, resp, "Content-Type: application/json\r\n")
+	assert.Contains(t, resp, "Content-Length: 14\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n{\"status\":505}"), resp)
+}
+
+func TestHeaderValidation(t *testing.T) {
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		if r.URL.Path == "/redirect" {
+			w.WriteStatusLine(response.Found)
+			h := response.GetDefaultHeaders(0)
+			h.Set("Location", r.Query().Get("to"))
+			w.WriteHeaders(h)
+			return
+		}
+		if r.URL.Path == "/body" {
+			_, err := r.BodyBytes()
+			if err != nil {
+				w.WriteError(response.BadRequest, "")
+				return
+			}
+		}
+		value, _ := r.Headers.Get("X-Long")
+		textHandler(value)(w, r)
+	}}
+	addr := startServer(t, s)
+
+	// Test: Obsolete line folding gets a 400
+	folded := "GET / HTTP/1.1\r\nX-Long: first\r\n second\r\nConnection: close\r\n\r\n"
+	assert.Contains(t, roundTrip(t, addr, folded), "HTTP/1.1 400 Bad Request\r\n")
+
+	// Test: Smuggling-prone framing gets a 400
+	assert.Contains(t, roundTrip(t, addr, "POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"), "HTTP/1.1 400 Bad Request\r\n")
+
+	// Test: Whitespace before the first header line can't smuggle a second request
+	resp := roundTrip(t, addr, "GET / HTTP/1.1\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /x HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"), resp)
+	assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1 "), resp)
+
+	// Test: Whitespace before the first trailer line gets a 400
+	resp = roundTrip(t, addr, "POST /body HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n X-Sum: a\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"), resp)
+
+	// Test: Handlers can't inject header lines
+	resp = roundTrip(t, addr, "GET /redirect?to=/home%0D%0ASet-Cookie:%20x=1 HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 302 Found\r\n", resp)
+
+	// Test: Folding is unfolded when the parser allows it
+	s = &Server{Handler: s.Handler, ParserOptions: request.ParserOptions{UnfoldObsFold: true}}
+	addr = startServer(t, s)
+	resp = roundTrip(t, addr, folded)
+	assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+	assert.True(t, strings.HasSuffix(resp, "first second"))
+}
+
+func TestHeadRequests(t *testing.T) {
+	s := &Server{Handler: textHandler("hello")}
+	addr := startServer(t, s)
+
+	// Test: HEAD gets headers only, and the connection stays usable
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	fmt.Fprint(c, "HEAD / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	head, get, ok := strings.Cut(string(resp), "\r\n\r\n")
+	require.True(t, ok)
+	assert.Contains(t, head, "Content-Length: 5\r\n")
+	assert.True(t, strings.HasPrefix(get, "HTTP/1.1 200 OK\r\n"), get)
+	assert.True(t, strings.HasSuffix(get, "\r\n\r\nhello"), get)
+}
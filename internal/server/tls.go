@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often a TLS server checks its certificate files
+// for changes.
+const certPollInterval = 10 * time.Second
+
+// ClientAuthMode is whether a TLS server with ClientCAs requires clients to
+// authenticate with a certificate.
+type ClientAuthMode int
+
+const (
+	// ClientCertRequired rejects clients without a valid certificate.
+	ClientCertRequired ClientAuthMode = iota
+	// ClientCertOptional lets clients connect without a certificate, but
+	// still rejects ones presenting a certificate that can't be verified.
+	ClientCertOptional
+)
+
+// KeyPair names the PEM files of a certificate and its private key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore holds certificates loaded from disk and picks one for each TLS
+// handshake by the server name the client asked for (SNI). Reloading
+// replaces the certificates for new handshakes without affecting
+// connections that are already established.
+type CertStore struct {
+	pairs []KeyPair
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	byName  map[string]*tls.Certificate
+	modTime map[string]time.Time
+}
+
+// LoadCertPool reads PEM certificates, such as the authorities trusted to
+// sign client certificates, from files into a pool.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", name)
+		}
+	}
+	return pool, nil
+}
+
+// LoadCertStore loads the given key pairs. The first pair is served to
+// clients whose server name matches none of the certificates.
+func LoadCertStore(pairs ...KeyPair) (*CertStore, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates given")
+	}
+	cs := &CertStore{pairs: pairs}
+	err := cs.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Reload reads every key pair from disk again. If any of them fails to load,
+// the certificates already loaded are kept and the error is returned.
+func (cs *CertStore) Reload() error {
+	modTime, err := cs.modTimes()
+	if err != nil {
+		return err
+	}
+
+	certs := make([]*tls.Certificate, 0, len(cs.pairs))
+	byName := make(map[string]*tls.Certificate)
+	for _, pair := range cs.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load certificate %s: %w", pair.CertFile, err)
+		}
+		certs = append(certs, &cert)
+		for _, name := range cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.certs = certs
+	cs.byName = byName
+	cs.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns the certificate for hello's server name, trying an
+// exact match before a wildcard one. It can be used as
+// tls.Config.GetCertificate.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := cs.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return cs.certs[0], nil
+}
+
+// Watch reloads the certificates whenever one of their files changes,
+// checking every interval until ctx is cancelled.
+func (cs *CertStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !cs.changed() {
+			continue
+		}
+		err := cs.Reload()
+		if err != nil {
+			log.Printf("unable to reload certificates: %v", err)
+			continue
+		}
+		log.Printf("reloaded certificates")
+	}
+}
+
+func (cs *CertStore) changed() bool {
+	modTime, err := cs.modTimes()
+	if err != nil {
+		// Files being replaced may briefly be missing; try again next time.
+		return false
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for name, t := range modTime {
+		if !t.Equal(cs.modTime[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *CertStore) modTimes() (map[string]time.Time, error) {
+	modTime := make(map[string]time.Time)
+	for _, pair := range cs.pairs {
+		for _, name := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(name)
+			if err != nil {
+				return nil, err
+			}
+			modTime[name] = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// tlsConfig returns the configuration StartTLS listens with.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if s.Certificates != nil {
+		config.GetCertificate = s.Certificates.GetCertificate
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("TLS server has no certificates")
+	}
+	if s.ClientCAs != nil {
+		config.ClientCAs = s.ClientCAs
+		switch s.ClientAuth {
+		case ClientCertRequired:
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		case ClientCertOptional:
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown client auth mode: %d", s.ClientAuth)
+		}
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return config, nil
+}
+
+// handshake completes the TLS handshake within the header timeout, reporting
+// whether it succeeded. Clients that fail certificate verification are
+// rejected here.
+func (s *Server) handshake(ctx context.Context, c *conn, tlsConn *tls.Conn) bool {
+	c.SetReadDeadline(deadline(time.Now(), s.headerTimeout()))
+	c.SetWriteDeadline(deadline(time.Now(), s.headerTimeout()))
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		log.Printf("TLS handshake error from %s: %v", c.RemoteAddr(), err)
+		return false
+	}
+	c.SetWriteDeadline(time.Time{})
+	state := tlsConn.ConnectionState()
+	c.tlsState = &state
+	return true
+}
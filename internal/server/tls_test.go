@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sevaergdm/httpfromtcp/internal/request"
+	"github.com/sevaergdm/httpfromtcp/internal/response"
+)
+
+// testCert is a certificate generated for a test, along with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert generates a certificate for commonName and dnsNames signed by
+// parent, or a self-signed one if parent is nil. Self-signed certificates
+// can also sign others.
+func newTestCert(t *testing.T, parent *testCert, usage x509.ExtKeyUsage, commonName string, dnsNames ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.cert.Raw}, PrivateKey: tc.key, Leaf: tc.cert}
+}
+
+// write saves the certificate and key as PEM files in dir.
+func (tc *testCert) write(t *testing.T, dir, name string) KeyPair {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(tc.key)
+	require.NoError(t, err)
+	pair := KeyPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return pair
+}
+
+// writeSelfSigned writes a self-signed server certificate for dnsNames and
+// its key into dir, returning their paths and the certificate.
+func writeSelfSigned(t *testing.T, dir, name string, dnsNames ...string) (KeyPair, *x509.Certificate) {
+	t.Helper()
+	tc := newTestCert(t, nil, x509.ExtKeyUsageServerAuth, dnsNames[0], dnsNames...)
+	return tc.write(t, dir, name), tc.cert
+}
+
+func startTLSServer(t *testing.T, s *Server) string {
+	t.Helper()
+	require.NoError(t, s.StartTLS(0))
+	t.Cleanup(func() { s.Close() })
+	return s.Listener.Addr().String()
+}
+
+func dialTLS(t *testing.T, addr, serverName string, roots ...*x509.Certificate) *tls.Conn {
+	t.Helper()
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+	c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, RootCAs: pool})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	pairA, certA := writeSelfSigned(t, dir, "a", "a.test", "*.a.test")
+	pairB, certB := writeSelfSigned(t, dir, "b", "b.test")
+	certs, err := LoadCertStore(pairA, pairB)
+	require.NoError(t, err)
+	s := &Server{Handler: textHandler("secure"), Certificates: certs}
+	addr := startTLSServer(t, s)
+
+	// Test: Serves HTTPS
+	c := dialTLS(t, addr, "a.test", certA)
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, string(resp), "\r\n\r\nsecure")
+
+	// Test: Certificate is chosen by SNI
+	c = dialTLS(t, addr, "b.test", certB)
+	assert.Equal(t, certB.SerialNumber, c.ConnectionState().PeerCertificates[0].SerialNumber)
+
+	// Test: Wildcard names match one label
+	c = dialTLS(t, addr, "www.a.test", certA)
+	assert.Equal(t, certA.SerialNumber, c.ConnectionState().PeerCertificates[0].SerialNumber)
+
+	// Test: Unknown names get the first certificate
+	c, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, certA.SerialNumber, c.ConnectionState().PeerCertificates[0].SerialNumber)
+
+	// Test: Server without certificates fails to start
+	assert.Error(t, (&Server{}).StartTLS(0))
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	pair, oldCert := writeSelfSigned(t, dir, "site", "site.test")
+	certs, err := LoadCertStore(pair)
+	require.NoError(t, err)
+	s := &Server{Handler: textHandler("ok"), Certificates: certs}
+	addr := startTLSServer(t, s)
+
+	existing := dialTLS(t, addr, "site.test", oldCert)
+	fmt.Fprint(existing, "GET / HTTP/1.1\r\n\r\n")
+	buf := make([]byte, 1024)
+	_, err = existing.Read(buf)
+	require.NoError(t, err)
+
+	// Test: Reload serves the new certificate to new connections
+	_, newCert := writeSelfSigned(t, dir, "site", "site.test")
+	require.NoError(t, certs.Reload())
+	c := dialTLS(t, addr, "site.test", newCert)
+	assert.Equal(t, newCert.SerialNumber, c.ConnectionState().PeerCertificates[0].SerialNumber)
+
+	// Test: Existing connections keep working after a reload
+	fmt.Fprint(existing, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	resp, err := io.ReadAll(existing)
+	require.NoError(t, err)
+	assert.Contains(t, string(resp), "HTTP/1.1 200 OK\r\n")
+
+	// Test: A broken file keeps the loaded certificate
+	require.NoError(t, os.WriteFile(pair.CertFile, []byte("garbage"), 0o600))
+	assert.Error(t, certs.Reload())
+	c = dialTLS(t, addr, "site.test", newCert)
+	assert.Equal(t, newCert.SerialNumber, c.ConnectionState().PeerCertificates[0].SerialNumber)
+
+	// Test: Watch reloads certificates when their files change
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certs.Watch(ctx, 10*time.Millisecond)
+	_, watchedCert := writeSelfSigned(t, dir, "site", "site.test")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(pair.CertFile, future, future))
+	require.Eventually(t, func() bool {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "site.test"})
+		return err == nil && cert.Leaf.SerialNumber.Cmp(watchedCert.SerialNumber) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverPair, serverCert := writeSelfSigned(t, dir, "server", "server.test")
+	certs, err := LoadCertStore(serverPair)
+	require.NoError(t, err)
+
+	ca := newTestCert(t, nil, x509.ExtKeyUsageClientAuth, "Test CA")
+	caPair := ca.write(t, dir, "ca")
+	clientCAs, err := LoadCertPool(caPair.CertFile)
+	require.NoError(t, err)
+	client := newTestCert(t, ca, x509.ExtKeyUsageClientAuth, "client", "client.internal")
+	stranger := newTestCert(t, newTestCert(t, nil, x509.ExtKeyUsageClientAuth, "Other CA"), x509.ExtKeyUsageClientAuth, "stranger")
+
+	identify := func(w *response.Writer, r *request.Request) {
+		cert := r.ClientCertificate()
+		if cert == nil {
+			textHandler("anonymous")(w, r)
+			return
+		}
+		textHandler(cert.Subject.CommonName+" "+strings.Join(cert.DNSNames, ","))(w, r)
+	}
+	get := func(addr string, clientCert *testCert) (string, error) {
+		config := &tls.Config{ServerName: "server.test", RootCAs: x509.NewCertPool()}
+		config.RootCAs.AddCert(serverCert)
+		if clientCert != nil {
+			// Present the certificate even when the server doesn't list its
+			// issuer as acceptable.
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert := clientCert.tlsCertificate()
+				return &cert, nil
+			}
+		}
+		c, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		fmt.Fprint(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+		resp, err := io.ReadAll(c)
+		if err == nil && len(resp) == 0 {
+			// With TLS 1.3 a rejected client only finds out when reading.
+			err = io.ErrUnexpectedEOF
+		}
+		return string(resp), err
+	}
+
+	required := &Server{Handler: identify, Certificates: certs, ClientCAs: clientCAs}
+	requiredAddr := startTLSServer(t, required)
+	optional := &Server{Handler: identify, Certificates: certs, ClientCAs: clientCAs, ClientAuth: ClientCertOptional}
+	optionalAddr := startTLSServer(t, optional)
+
+	// Test: Verified client identity is exposed to handlers
+	resp, err := get(requiredAddr, client)
+	require.NoError(t, err)
+	assert.Contains(t, resp, "\r\n\r\nclient client.internal")
+
+	// Test: Required mode rejects clients without a certificate
+	_, err = get(requiredAddr, nil)
+	assert.Error(t, err)
+
+	// Test: Certificates from an untrusted CA are rejected
+	_, err = get(requiredAddr, stranger)
+	assert.Error(t, err)
+	_, err = get(optionalAddr, stranger)
+	assert.Error(t, err)
+
+	// Test: Optional mode serves clients without a certificate
+	resp, err = get(optionalAddr, nil)
+	require.NoError(t, err)
+	assert.Contains(t, resp, "\r\n\r\nanonymous")
+	resp, err = get(optionalAddr, client)
+	require.NoError(t, err)
+	assert.Contains(t, resp, "\r\n\r\nclient client.internal")
+}